@@ -0,0 +1,100 @@
+// Identity based access control for the admin surface (dashboard, /metrics
+// and admin APIs), whether served on the tailnet or a local listener.
+package access
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+
+	"mattb.nz/web/metrics/config"
+)
+
+// Resolves the tailnet identity behind a remote address, as done by
+// tailscale.LocalClient.
+type WhoIser interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+type identityKey struct{}
+
+// Returns a handler which resolves the caller of each request with whois
+// before passing it on to next. The identity is available via FromRequest.
+func Middleware(whois WhoIser, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := resolve(r.Context(), whois, r.RemoteAddr)
+		if err != nil {
+			// Treated as an unknown identity, which only "*" rules allow.
+			log.Printf("Could not identify %s: %v", r.RemoteAddr, err)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// Returns a handler which authenticates each request as one of the configured
+// Admin.Users, by bearer token or basic auth, before passing it on to next.
+// The identity is available via FromRequest.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := config.Current().Admin
+		var user config.AdminUser
+		ok := false
+		if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			user, ok = admin.UserForToken(token)
+		} else if name, password, found := r.BasicAuth(); found {
+			user, ok = admin.UserForPassword(name, password)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := config.Identity{User: user.Name}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+func resolve(ctx context.Context, whois WhoIser, remoteAddr string) (config.Identity, error) {
+	who, err := whois.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return config.Identity{}, err
+	}
+	if who.Node != nil && who.Node.IsTagged() {
+		return config.Identity{Tags: who.Node.Tags}, nil
+	}
+	if who.UserProfile != nil {
+		return config.Identity{User: who.UserProfile.LoginName}, nil
+	}
+	return config.Identity{}, nil
+}
+
+// Returns the identity of the caller of r, as resolved by Middleware.
+func FromRequest(r *http.Request) config.Identity {
+	id, _ := r.Context().Value(identityKey{}).(config.Identity)
+	return id
+}
+
+// Returns true if the caller of r may view the dashboard of host, or with
+// host "*", everything. If not, a 403 response is written.
+func Allowed(w http.ResponseWriter, r *http.Request, host string) bool {
+	id := FromRequest(r)
+	if config.Current().CanView(id, host) {
+		return true
+	}
+	log.Printf("Denied %s access to %s", id, r.URL.Path)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// Returns a handler which only passes requests on to next from callers who
+// may view every site.
+func RequireAll(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Allowed(w, r, "*") {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
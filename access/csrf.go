@@ -0,0 +1,37 @@
+package access
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Key CSRF tokens are signed with. Tokens only need to outlive the page
+// they're in, so a new key each run is fine.
+var csrfKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// Returns a token to include as the csrf_token value of forms which change
+// state, so CheckCSRF can tell they were submitted from our pages.
+func CSRFToken(r *http.Request) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(FromRequest(r).String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if r carries the caller's CSRF token, see CSRFToken. If not, a
+// 403 response is written.
+func CheckCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if hmac.Equal([]byte(r.PostFormValue("csrf_token")), []byte(CSRFToken(r))) {
+		return true
+	}
+	log.Printf("Denied %s %s without a valid CSRF token", FromRequest(r), r.URL.Path)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,114 @@
+// Administrative APIs, served on the tailnet alongside the dashboard.
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+)
+
+// Builds a query for a data subject.
+//
+// IPs may be stored hashed, so the query includes the hashed form of ip for
+// each site using config.IP_HASH. Truncated IPs are shared with other people
+// so are deliberately not matched.
+func NewSubjectQuery(email, name, ip, session string) db.SubjectQuery {
+	q := db.SubjectQuery{Email: email, Name: name, SessionID: session}
+	if ip != "" {
+		conf := config.Current()
+		q.IPs = append(q.IPs, ip)
+		for _, site := range conf.Sites {
+			if site.IPMode == config.IP_HASH {
+				q.IPs = append(q.IPs, conf.AnonymiseIP(site.Host, ip))
+			}
+		}
+	}
+	return q
+}
+
+func subjectQuery(r *http.Request) db.SubjectQuery {
+	return NewSubjectQuery(r.FormValue("email"), r.FormValue("name"), r.FormValue("ip"), r.FormValue("session"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Could not write JSON response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Exports all data held matching the email, name, ip or session parameters.
+func SubjectExport(w http.ResponseWriter, r *http.Request) {
+	q := subjectQuery(r)
+	if q.IsEmpty() {
+		http.Error(w, "one of email, name, ip or session is required", http.StatusBadRequest)
+		return
+	}
+	data, err := db.FindSubjectData(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// The body of an erasure request. It must be JSON, rather than form values,
+// so other sites can't have a caller's browser submit one (as their forms
+// can't send JSON without a CORS preflight).
+type eraseRequest struct {
+	Email   string
+	Name    string
+	IP      string
+	Session string
+	Action  db.ErasureAction // Defaults to db.ERASE_DELETE.
+	Reason  string
+}
+
+// Deletes or redacts (per Action) all data held matching the Email, Name, IP
+// or Session of the JSON request body.
+func SubjectErase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "request body must be JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req eraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "could not decode request body", http.StatusBadRequest)
+		return
+	}
+	q := NewSubjectQuery(req.Email, req.Name, req.IP, req.Session)
+	if q.IsEmpty() {
+		http.Error(w, "one of Email, Name, IP or Session is required", http.StatusBadRequest)
+		return
+	}
+	action := req.Action
+	if action == "" {
+		action = db.ERASE_DELETE
+	} else if action != db.ERASE_DELETE && action != db.ERASE_REDACT {
+		http.Error(w, "Action must be delete or redact", http.StatusBadRequest)
+		return
+	}
+	erasure, err := db.EraseSubjectData(q, action, req.Reason, access.FromRequest(r).String())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Erased subject data (%s by %s): %d mail logs, %d event logs", erasure.Action, erasure.RequestedBy, erasure.MailLogs, erasure.EventLogs)
+	writeJSON(w, http.StatusOK, erasure)
+}
@@ -0,0 +1,138 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/health"
+	"mattb.nz/web/metrics/spool"
+	"mattb.nz/web/metrics/tailscale"
+)
+
+// Registers the health checks of the components used with conf.
+func registerHealthChecks(conf config.Config) {
+	// Only critical without the spool, as otherwise events are spooled while
+	// the database is unavailable. Once the spool is full they're dropped.
+	health.Register("database", !spool.Enabled(), db.Check)
+	health.RegisterDetailed("spool", true, checkSpool)
+	if conf.Admin.Mode == config.ADMIN_TAILSCALE {
+		health.Register("tailscale", false, func(ctx context.Context) error {
+			if !tailscale.Connected.Load() {
+				return errors.New("not connected")
+			}
+			return nil
+		})
+	}
+	health.Register("smtp", false, checkSMTP)
+	health.RegisterDetailed("mailqueue", false, checkMailQueue)
+}
+
+// Checks the spool isn't dropping events as it is full, reporting the events
+// waiting to be stored.
+func checkSpool(ctx context.Context) (map[string]any, error) {
+	if !spool.Enabled() {
+		return nil, health.ErrDisabled
+	}
+	n, size := spool.Pending()
+	details := map[string]any{
+		"pending":        n,
+		"bytes":          size,
+		"oldest_seconds": int(spool.Lag().Seconds()),
+	}
+	if spool.Full() {
+		return details, fmt.Errorf("full with %d events, dropping new ones", n)
+	}
+	return details, nil
+}
+
+// Checks no contact form mail has been given up on, reporting the mail
+// waiting to be sent.
+func checkMailQueue(ctx context.Context) (map[string]any, error) {
+	counts, err := db.CountMail()
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]any{"pending": counts[db.MAIL_PENDING], "dead": counts[db.MAIL_DEAD]}
+	oldest, err := db.OldestPendingMail()
+	if err != nil {
+		return details, err
+	}
+	if !oldest.IsZero() {
+		details["oldest_seconds"] = int(time.Since(oldest).Seconds())
+	}
+	if n := counts[db.MAIL_DEAD]; n > 0 {
+		return details, fmt.Errorf("%d messages could not be delivered", n)
+	}
+	return details, nil
+}
+
+// Checks the SMTP server accepts connections, by waiting for its greeting.
+func checkSMTP(ctx context.Context) error {
+	mail := config.Current().Mail
+	if mail.Host == "" {
+		return health.ErrDisabled
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", mail.Addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, mail.Host)
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func writeHealth(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Could not write health report: %v", err)
+	}
+}
+
+// The public health probes only give the overall status; the details of
+// each component are for the admin surface, see HealthReport.
+type healthStatus struct {
+	Status string `json:"status"`
+}
+
+// Reports our overall health. As a liveness check this always succeeds while
+// we're able to respond; the status shows if we're degraded.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthStatus{health.Latest().Status})
+}
+
+// Reports whether we're ready to receive traffic: started, not shutting down,
+// and with no critical component failing.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{"draining"})
+		return
+	}
+	report := health.Latest()
+	if !report.Ready() {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{report.Status})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthStatus{report.Status})
+}
+
+// Reports the health of each component, including their errors.
+func HealthReport(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, health.Latest())
+}
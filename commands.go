@@ -0,0 +1,161 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"mattb.nz/web/metrics/admin"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+)
+
+// One-off administrative commands, run as `metrics <command> [args...]`.
+//
+// The config is loaded from configFile before the command runs, unless
+// noConfig is set.
+type command struct {
+	help     string
+	run      func(args []string) error
+	noConfig bool
+}
+
+var commands = map[string]command{
+	"backfill-useragents": {help: "Re-parse all stored User-Agents into browser, OS and device", run: backfillUserAgents},
+	"check-config":        {help: "Validate a config file (default $CONFIG_FILE) and report all problems", run: checkConfig, noConfig: true},
+	"reanonymise-ips":     {help: "Re-apply each site's IPMode to IP addresses already stored", run: reanonymiseIPs},
+	"subject-export":      {help: "Export all data held about a person as JSON", run: subjectExport},
+	"subject-erase":       {help: "Delete or redact all data held about a person", run: subjectErase},
+}
+
+func runCommand(configFile string, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := []string{}
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown command %q, available commands:\n", name)
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %-20s %s\n", n, commands[n].help)
+		}
+		return fmt.Errorf("unknown command %s", name)
+	}
+	if !cmd.noConfig {
+		conf, err := config.LoadConfig(configFile)
+		if err != nil {
+			return fmt.Errorf("could not load config: %w", err)
+		}
+		config.Set(conf)
+	}
+	return cmd.run(args)
+}
+
+func checkConfig(args []string) error {
+	filename := os.Getenv("CONFIG_FILE")
+	if len(args) > 0 {
+		filename = args[0]
+	}
+	conf, err := config.LoadConfig(filename)
+	var problems config.ValidationErrors
+	if errors.As(err, &problems) {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return fmt.Errorf("%s has %d problem(s)", filename, len(problems))
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid (%d sites)\n", filename, len(conf.Sites))
+	return nil
+}
+
+func backfillUserAgents(args []string) error {
+	if err := db.Init(config.Current()); err != nil {
+		return err
+	}
+	n, err := db.BackfillUserAgents()
+	if err != nil {
+		return err
+	}
+	log.Printf("Updated %d user agents", n)
+	return nil
+}
+
+func reanonymiseIPs(args []string) error {
+	conf := config.Current()
+	if err := db.Init(conf); err != nil {
+		return err
+	}
+	for _, site := range conf.Sites {
+		anonymise := func(ip string) string {
+			return conf.AnonymiseIP(site.Host, ip)
+		}
+		for _, table := range []interface{}{&db.EventLog{}, &db.MailLog{}} {
+			n, err := db.ReanonymiseIPs(table, site.Host, anonymise)
+			if err != nil {
+				return fmt.Errorf("%s: %w", site.Host, err)
+			}
+			log.Printf("%s: re-anonymised IPs in %d %T rows", site.Host, n, table)
+		}
+	}
+	return nil
+}
+
+// Parses the flags identifying a data subject, plus any extra flags defined
+// by setup.
+func subjectFlags(name string, args []string, setup func(*flag.FlagSet)) (db.SubjectQuery, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	email := fs.String("email", "", "email address (matching the whole contact details or an email field, ignoring case)")
+	subject := fs.String("name", "", "name given in the contact form")
+	ip := fs.String("ip", "", "IP address")
+	session := fs.String("session", "", "event session id")
+	if setup != nil {
+		setup(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return db.SubjectQuery{}, err
+	}
+	q := admin.NewSubjectQuery(*email, *subject, *ip, *session)
+	if q.IsEmpty() {
+		return q, errors.New("one of -email, -name, -ip or -session is required")
+	}
+	return q, db.Init(config.Current())
+}
+
+func subjectExport(args []string) error {
+	q, err := subjectFlags("subject-export", args, nil)
+	if err != nil {
+		return err
+	}
+	data, err := db.FindSubjectData(q)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+func subjectErase(args []string) error {
+	var action, reason string
+	q, err := subjectFlags("subject-erase", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&action, "action", string(db.ERASE_DELETE), "delete or redact")
+		fs.StringVar(&reason, "reason", "", "reason for the erasure, recorded in the audit log")
+	})
+	if err != nil {
+		return err
+	}
+	erasure, err := db.EraseSubjectData(q, db.ErasureAction(action), reason, "cli")
+	if err != nil {
+		return err
+	}
+	log.Printf("Erased subject data (%s): %d mail logs, %d event logs", erasure.Action, erasure.MailLogs, erasure.EventLogs)
+	return nil
+}
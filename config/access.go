@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Grants the tailnet identities in Who access to the dashboards of Sites.
+//
+// Who lists user login names (alice@example.com) or Admin.Users names, groups
+// defined in Config.Groups (group:eng), node tags (tag:monitoring) or * for
+// anyone.
+// Sites lists site hosts, or * for every site along with the service wide
+// endpoints (/metrics and /admin).
+type AccessRule struct {
+	Who   []string
+	Sites []string
+}
+
+// The identity of a dashboard user.
+type Identity struct {
+	User string   // Login name or admin user name, empty for tagged nodes
+	Tags []string // Tags of the node, if it's tagged
+}
+
+func (id Identity) String() string {
+	if len(id.Tags) > 0 {
+		return strings.Join(id.Tags, ",")
+	}
+	if id.User == "" {
+		return "unknown"
+	}
+	return id.User
+}
+
+// Returns true if id may view the dashboard of host, or with host "*", all
+// sites and the service wide endpoints.
+//
+// Without any Access rules, everyone on the tailnet may view everything.
+func (c Config) CanView(id Identity, host string) bool {
+	if len(c.Access) == 0 {
+		return true
+	}
+	for _, rule := range c.Access {
+		if !slices.Contains(rule.Sites, "*") && !slices.Contains(rule.Sites, host) {
+			continue
+		}
+		for _, who := range rule.Who {
+			if c.isIdentity(id, who) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the sites id may view.
+func (c Config) VisibleSites(id Identity) []MonitoredSite {
+	var sites []MonitoredSite
+	for _, site := range c.Sites {
+		if c.CanView(id, site.Host) {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// Returns true if id is who, see AccessRule.
+func (c Config) isIdentity(id Identity, who string) bool {
+	switch {
+	case who == "*":
+		return true
+	case strings.HasPrefix(who, "tag:"):
+		return slices.Contains(id.Tags, who)
+	case strings.HasPrefix(who, "group:"):
+		return id.User != "" && slices.Contains(c.Groups[who], id.User)
+	}
+	return id.User != "" && who == id.User
+}
+
+func (c *Config) validateAccess(errs *ValidationErrors) {
+	for _, group := range slices.Sorted(maps.Keys(c.Groups)) {
+		users := c.Groups[group]
+		if !strings.HasPrefix(group, "group:") {
+			errs.add("Groups."+group, "group names must start with group:")
+		}
+		for i, user := range users {
+			if !strings.Contains(user, "@") {
+				errs.add(fmt.Sprintf("Groups.%s[%d]", group, i), "%q is not a user login name", user)
+			}
+		}
+	}
+	for i, rule := range c.Access {
+		path := fmt.Sprintf("Access[%d]", i)
+		if len(rule.Who) == 0 {
+			errs.add(path+".Who", "at least one identity is required")
+		}
+		for j, who := range rule.Who {
+			wpath := fmt.Sprintf("%s.Who[%d]", path, j)
+			switch {
+			case who == "*":
+			case strings.HasPrefix(who, "tag:"):
+				if len(who) == len("tag:") {
+					errs.add(wpath, "tag name must not be empty")
+				}
+			case strings.HasPrefix(who, "group:"):
+				if _, ok := c.Groups[who]; !ok {
+					errs.add(wpath, "%s is not defined in Groups", who)
+				}
+			case !strings.Contains(who, "@") && !c.Admin.isUser(who):
+				errs.add(wpath, "%q is not a user login name, admin user, group:, tag: or *", who)
+			}
+		}
+		if len(rule.Sites) == 0 {
+			errs.add(path+".Sites", "at least one site is required")
+		}
+		for j, host := range rule.Sites {
+			if host != "*" && c.GetSite(host).Host == "" {
+				errs.add(fmt.Sprintf("%s.Sites[%d]", path, j), "%s is not a configured site", host)
+			}
+		}
+	}
+}
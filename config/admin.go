@@ -0,0 +1,107 @@
+package config
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// How the admin surface (dashboard, /metrics and admin APIs) is served.
+type AdminMode string
+
+const (
+	ADMIN_TAILSCALE AdminMode = ""      // On the tailnet, identified by WhoIs (the default).
+	ADMIN_LOCAL     AdminMode = "local" // On Listen, authenticated as one of Users.
+)
+
+// Settings for the admin surface.
+type AdminConfig struct {
+	Mode AdminMode
+	// For ADMIN_LOCAL, the address to listen on: host:port (e.g.
+	// 127.0.0.1:9090) or unix:/path/to/socket.
+	Listen string
+	// Users who may authenticate to the local listener.
+	Users []AdminUser
+}
+
+// A user of the local admin listener. Name is their identity for Access
+// rules, in place of a tailnet login name.
+type AdminUser struct {
+	Name     string
+	Password string // For HTTP basic auth, or empty
+	Token    string // For Authorization: Bearer, or empty
+}
+
+// Returns the network ("tcp" or "unix") and address to listen on.
+func (a AdminConfig) Network() (string, string) {
+	if path, ok := strings.CutPrefix(a.Listen, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", a.Listen
+}
+
+// Returns the admin user with the given bearer token, if any.
+func (a AdminConfig) UserForToken(token string) (AdminUser, bool) {
+	for _, user := range a.Users {
+		if user.Token != "" && secureEqual(user.Token, token) {
+			return user, true
+		}
+	}
+	return AdminUser{}, false
+}
+
+// Returns the admin user with the given basic auth name and password, if any.
+func (a AdminConfig) UserForPassword(name, password string) (AdminUser, bool) {
+	for _, user := range a.Users {
+		if user.Name == name && user.Password != "" && secureEqual(user.Password, password) {
+			return user, true
+		}
+	}
+	return AdminUser{}, false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a AdminConfig) isUser(name string) bool {
+	for _, user := range a.Users {
+		if user.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a AdminConfig) validate(errs *ValidationErrors) {
+	switch a.Mode {
+	case ADMIN_TAILSCALE:
+	case ADMIN_LOCAL:
+		if _, addr := a.Network(); addr == "" {
+			errs.add("Admin.Listen", "must be set for local mode")
+		}
+		if len(a.Users) == 0 {
+			errs.add("Admin.Users", "at least one user is required for local mode")
+		}
+	default:
+		errs.add("Admin.Mode", "unknown mode %q", a.Mode)
+	}
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	for i, user := range a.Users {
+		path := fmt.Sprintf("Admin.Users[%d]", i)
+		if user.Name == "" {
+			errs.add(path+".Name", "must be set")
+		} else if names[user.Name] {
+			errs.add(path+".Name", "%s is already configured", user.Name)
+		}
+		names[user.Name] = true
+		if user.Password == "" && user.Token == "" {
+			errs.add(path, "one of Password or Token is required")
+		}
+		if user.Token != "" && tokens[user.Token] {
+			errs.add(path+".Token", "token is already used by another user")
+		}
+		tokens[user.Token] = true
+	}
+}
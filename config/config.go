@@ -1,18 +1,72 @@
 package config
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
-	"strings"
+	"reflect"
+	"regexp"
 )
 
 type MonitoredSite struct {
-	Host           string
+	Host string
+	// Origin patterns (scheme://host[:port]) allowed to send events for
+	// this site, see originPattern for the wildcards supported.
 	AllowedOrigins []string
+	_origins       []originPattern
 	Contacts       []string
+	// The fields of the site's contact form, defaults to
+	// DEFAULT_CONTACT_FORM.
+	ContactForm []FormField
+	// How contact form submissions are emailed to Contacts.
+	ContactMail ContactMailConfig
+
+	// Remove utm_* parameters from the stored page once they've been
+	// extracted into the campaign columns.
+	StripCampaignParams bool
+	// Click targets (element IDs) which count as a goal conversion.
+	Goals []string
+
+	// How client IPs are stored, defaults to IP_FULL.
+	IPMode IPMode
+	// What to do with events from browsers sending DNT or GPC signals,
+	// defaults to PRIVACY_IGNORE.
+	PrivacySignals PrivacyPolicy
+
+	// Events to ignore for this site, in addition to the global IgnoreNets.
+	// Networks are in CIDR notation. Paths (e.g. /admin/*) are matched
+	// against the path of the page, and User-Agents (e.g. *HeadlessChrome*)
+	// case-insensitively against the whole header, with * matching anything.
+	IgnoreNets        []string
+	IgnorePaths       []string
+	IgnoreUserAgents  []string
+	_ignoredNets      []*net.IPNet
+	_ignorePaths      []*regexp.Regexp
+	_ignoreUserAgents []*regexp.Regexp
+
+	// Contact form spam defences.
+	Spam SpamConfig
+}
+
+// Handling of events from browsers sending Do Not Track (DNT: 1) or Global
+// Privacy Control (Sec-GPC: 1) signals.
+type PrivacyPolicy string
+
+const (
+	PRIVACY_IGNORE    PrivacyPolicy = ""          // Record the event as normal.
+	PRIVACY_DROP      PrivacyPolicy = "drop"      // Discard the event entirely.
+	PRIVACY_COUNT     PrivacyPolicy = "count"     // Only count the event in the live site data.
+	PRIVACY_ANONYMISE PrivacyPolicy = "anonymise" // Record the event without IP, User-Agent or IDs.
+)
+
+func (p PrivacyPolicy) validate() error {
+	switch p {
+	case PRIVACY_IGNORE, PRIVACY_DROP, PRIVACY_COUNT, PRIVACY_ANONYMISE:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q", p)
 }
 
 type Config struct {
@@ -24,9 +78,38 @@ type Config struct {
 	// List of networks to ignore requests from in CIDR notation
 	IgnoreNets   []string
 	_ignoredNets []*net.IPNet
+
+	// Secret key for sites using IPMode hash.
+	IPHashSecret string
+	// Secret key for signing contact form tokens, see SpamConfig. If not set,
+	// a random key is used, so tokens issued before a restart are rejected.
+	ContactTokenSecret string
+
+	// Path to a MaxMind format (MMDB) city or country database used to
+	// geolocate events. Optional.
+	GeoIPDatabase string
+	// Add a country label to the events_total metric.
+	PromCountryLabel bool
+
+	// Maximum size of the spool of events kept on disk (in StateDirectory)
+	// while the database is unavailable, see SpoolLimit.
+	SpoolMaxBytes int64
+
+	Mail MailConfig
+
+	Admin AdminConfig
+	// Who may view which sites' dashboards, see AccessRule.
+	Access []AccessRule
+	// Tailnet users in each group:name used by Access. (Tailscale doesn't
+	// tell us which groups a user is in.)
+	Groups map[string][]string
 }
 
-// Load config from JSON file
+// Load config from a JSON, HuJSON or YAML file, see configFormat.
+//
+// String values may reference environment variables as ${VAR}. The config is
+// validated, with all problems found returned as ValidationErrors giving the
+// line of the file each was found on.
 func LoadConfig(filename string) (Config, error) {
 	// Open the file.
 	f, err := os.Open(filename)
@@ -41,47 +124,67 @@ func LoadConfig(filename string) (Config, error) {
 		return Config{}, err
 	}
 
-	// Unmarshal the JSON data into the provided interface.
-	config := Config{}
-	err = json.Unmarshal(b, &config)
+	config, lines, err := decodeConfig(configFormat(filename), b)
 	if err != nil {
 		return Config{}, err
 	}
 
-	// Parse the ignored networks
-	for _, cidrNet := range config.IgnoreNets {
-		_, net, err := net.ParseCIDR(cidrNet)
-		if err != nil {
-			return Config{}, fmt.Errorf("could not parse ignored network %s: %v", cidrNet, err)
+	errs := config.interpolateEnv()
+	errs = append(errs, config.Mail.resolve()...)
+	var problems ValidationErrors
+	if err := config.Validate(); errors.As(err, &problems) {
+		errs = append(errs, problems...)
+	}
+	if len(errs) > 0 {
+		for i := range errs {
+			errs[i].Line = lines.line(errs[i].Path)
 		}
-		config._ignoredNets = append(config._ignoredNets, net)
+		return Config{}, errs
 	}
-
 	return config, nil
 }
 
-func (c Config) GetHostForOrigin(origin string) string {
+// Default for Config.SpoolMaxBytes.
+const DEFAULT_SPOOL_MAX_BYTES = 64 << 20
+
+// Returns the maximum size of the event spool.
+func (c Config) SpoolLimit() int64 {
+	if c.SpoolMaxBytes == 0 {
+		return DEFAULT_SPOOL_MAX_BYTES
+	}
+	return c.SpoolMaxBytes
+}
+
+// Returns the site which allows origin and the AllowedOrigins pattern that
+// matched it. If no site allows origin, an empty site (with Host "") is
+// returned.
+func (c Config) GetHostForOrigin(origin string) (MonitoredSite, string) {
+	o, err := parseOrigin(origin)
+	if err != nil {
+		return MonitoredSite{}, ""
+	}
 	for _, site := range c.Sites {
-		for _, allowed := range site.AllowedOrigins {
-			if strings.HasPrefix(origin, allowed) {
-				return site.Host
+		for _, allowed := range site._origins {
+			if allowed.matches(o) {
+				return site, allowed.Pattern
 			}
 		}
 	}
-	return ""
+	return MonitoredSite{}, ""
 }
 
+// Returns true if ip is in the global IgnoreNets, see also IgnoreReason.
 func (c Config) IsIgnoredIP(ip string) bool {
-	ipAddr := net.ParseIP(ip)
-	if ipAddr == nil {
-		return false
-	}
-	for _, net := range c._ignoredNets {
-		if net.Contains(ipAddr) {
-			return true
+	return containsIP(c._ignoredNets, ip)
+}
+
+func (c Config) GetSite(host string) MonitoredSite {
+	for _, site := range c.Sites {
+		if site.Host == host {
+			return site
 		}
 	}
-	return false
+	return MonitoredSite{}
 }
 
 func (c Config) HostContacts(host string) []string {
@@ -92,3 +195,36 @@ func (c Config) HostContacts(host string) []string {
 	}
 	return []string{}
 }
+
+// Returns s without the fields compiled from its config by Validate.
+func (s MonitoredSite) uncompiled() MonitoredSite {
+	s._origins = nil
+	s._ignoredNets = nil
+	s._ignorePaths = nil
+	s._ignoreUserAgents = nil
+	return s
+}
+
+// Returns the hosts of sites which were added, removed or changed in newer.
+func (c Config) SiteChanges(newer Config) (added, removed, changed []string) {
+	old := make(map[string]MonitoredSite)
+	for _, site := range c.Sites {
+		old[site.Host] = site.uncompiled()
+	}
+	for _, site := range newer.Sites {
+		site = site.uncompiled()
+		prev, ok := old[site.Host]
+		if !ok {
+			added = append(added, site.Host)
+		} else if !reflect.DeepEqual(prev, site) {
+			changed = append(changed, site.Host)
+		}
+		delete(old, site.Host)
+	}
+	for _, site := range c.Sites {
+		if _, ok := old[site.Host]; ok {
+			removed = append(removed, site.Host)
+		}
+	}
+	return added, removed, changed
+}
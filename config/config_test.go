@@ -1,6 +1,13 @@
 package config
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestLoadJSONConfig(t *testing.T) {
 	config, err := LoadConfig("testdata/goodconfig.json")
@@ -45,26 +52,288 @@ func TestLoadJSONConfig(t *testing.T) {
 	}
 }
 
+func Test_ConfigFormats(t *testing.T) {
+	want, err := LoadConfig("testdata/goodconfig.json")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	for _, filename := range []string{"testdata/goodconfig.hujson", "testdata/goodconfig.yaml"} {
+		conf, err := LoadConfig(filename)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", filename, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf, want) {
+			t.Errorf("%s: expected %+v, got %+v", filename, want, conf)
+		}
+	}
+
+	_, err = LoadConfig("testdata/invalid.yaml")
+	var problems ValidationErrors
+	if !errors.As(err, &problems) {
+		t.Fatal("Expected ValidationErrors, got", err)
+	}
+	lines := map[string]int{
+		"Sites[0].AllowedOrigins[1]": 6,
+		"Sites[1].Host":              7,
+		"Sites[1].AllowedOrigins":    8,
+	}
+	if len(problems) != len(lines) {
+		t.Errorf("Expected %d problems, got %d: %v", len(lines), len(problems), problems)
+	}
+	for _, p := range problems {
+		if p.Line != lines[p.Path] {
+			t.Errorf("Expected %s on line %d, got %s", p.Path, lines[p.Path], p)
+		}
+	}
+
+	// Errors while decoding also give the line.
+	tests := []struct {
+		filename string
+		msg      string
+	}{
+		{"testdata/badtype.yaml", "line 7: mail.port: expected string, got number"},
+		{"testdata/trailingcomma.json", "line 3: invalid character '}'"},
+		{"testdata/broken.hujson", "line 4, column 5"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(tt.filename)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.filename, tt.msg, err)
+		}
+	}
+}
+
 func Test_GetHostForReferer(t *testing.T) {
 	conf, err := LoadConfig("testdata/goodconfig.json")
 	if err != nil {
 		t.Error("Expected no error, got", err)
 	}
 
-	host := conf.GetHostForOrigin("http://test.com")
+	site, pattern := conf.GetHostForOrigin("http://test.com")
+	if site.Host != "test.com" || pattern != "http://test.com" {
+		t.Errorf("Expected test.com via http://test.com, got %s via %s", site.Host, pattern)
+	}
+	if len(site.Contacts) != 1 {
+		t.Error("Expected matching site config to be returned, got", site)
+	}
+
+	host := matchHost(conf, "http://test.com")
 	if host != "test.com" {
 		t.Error("Expected test.com, got", host)
 	}
 
-	host = conf.GetHostForOrigin("http://test2.com")
+	host = matchHost(conf, "http://test2.com")
 	if host != "another.com" {
 		t.Error("Expected another.com, got", host)
 	}
 
-	host = conf.GetHostForOrigin("http://test3.com")
+	host = matchHost(conf, "http://test3.com")
 	if host != "" {
 		t.Error("Expected empty string, got", host)
 	}
+
+	// Origins must match on scheme, host and port, not just prefix.
+	for _, origin := range []string{
+		"http://test.com.evil.net",
+		"http://test.com:8080",
+		"https://test.com",
+		"http://evil.test.com",
+		"null",
+		"",
+	} {
+		if host := matchHost(conf, origin); host != "" {
+			t.Errorf("Expected %s not to match, got %s", origin, host)
+		}
+	}
+	if host := matchHost(conf, "HTTP://Test.com:80"); host != "test.com" {
+		t.Error("Expected test.com, got", host)
+	}
+}
+
+func Test_OriginPatterns(t *testing.T) {
+	conf := Config{Sites: []MonitoredSite{
+		{Host: "sub.com", AllowedOrigins: []string{"https://*.sub.com"}},
+		{Host: "preview.com", AllowedOrigins: []string{"https://pr-*.preview.example.com"}},
+		{Host: "anyscheme.com", AllowedOrigins: []string{"*://anyscheme.com"}},
+		{Host: "anyport.com", AllowedOrigins: []string{"http://localhost:*"}},
+		{Host: "port.com", AllowedOrigins: []string{"https://port.com:8443", "http://[::1]:3000/"}},
+	}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	tests := []struct {
+		origin  string
+		want    string
+		pattern string
+	}{
+		{"https://www.sub.com", "sub.com", "https://*.sub.com"},
+		{"https://a.b.sub.com", "sub.com", "https://*.sub.com"},
+		{"https://sub.com", "", ""},
+		{"http://www.sub.com", "", ""},
+		{"https://www.sub.com:8443", "", ""},
+		{"https://www.sub.com.evil.net", "", ""},
+		{"https://evilsub.com", "", ""},
+		{"https://pr-123.preview.example.com", "preview.com", "https://pr-*.preview.example.com"},
+		{"https://pr-.preview.example.com", "preview.com", "https://pr-*.preview.example.com"},
+		{"https://pr-1.x.preview.example.com", "", ""},
+		{"https://x.pr-1.preview.example.com", "", ""},
+		{"https://prod.preview.example.com", "", ""},
+		{"http://anyscheme.com", "anyscheme.com", "*://anyscheme.com"},
+		{"https://anyscheme.com", "anyscheme.com", "*://anyscheme.com"},
+		{"https://anyscheme.com:444", "", ""},
+		{"http://localhost", "anyport.com", "http://localhost:*"},
+		{"http://localhost:1313", "anyport.com", "http://localhost:*"},
+		{"https://localhost:1313", "", ""},
+		{"https://port.com:8443", "port.com", "https://port.com:8443"},
+		{"https://port.com", "", ""},
+		{"http://[::1]:3000", "port.com", "http://[::1]:3000/"},
+		{"null", "", ""},
+	}
+	for _, test := range tests {
+		site, pattern := conf.GetHostForOrigin(test.origin)
+		if site.Host != test.want || pattern != test.pattern {
+			t.Errorf("GetHostForOrigin(%s) = %q via %q, want %q via %q", test.origin, site.Host, pattern, test.want, test.pattern)
+		}
+	}
+
+	for _, bad := range []string{
+		"test.com",
+		"ftp://test.com",
+		"https://test.com/path",
+		"https://test.com?q",
+		"https://user@test.com",
+		"https://test.com:port",
+		"https://te st.com",
+		"https://",
+	} {
+		if _, err := compileOrigin(bad); err == nil {
+			t.Errorf("Expected error compiling %q, got nil", bad)
+		}
+	}
+
+	for _, test := range []struct {
+		a, b     string
+		overlaps bool
+	}{
+		{"https://*.test.com", "https://pr-*.test.com", true},
+		{"https://*.test.com", "https://www.test.com", true},
+		{"https://*.test.com", "https://test.com", false},
+		{"https://*.test.com", "http://www.test.com", false},
+		{"*://www.test.com", "http://www.test.com", true},
+		{"http://localhost:*", "http://localhost:3000", true},
+		{"http://localhost:3000", "http://localhost:3001", false},
+		{"https://pr-*.test.com", "https://qa-*.test.com", false},
+	} {
+		a, errA := compileOrigin(test.a)
+		b, errB := compileOrigin(test.b)
+		if errA != nil || errB != nil {
+			t.Fatalf("Could not compile %s or %s: %v %v", test.a, test.b, errA, errB)
+		}
+		if got := a.overlaps(b); got != test.overlaps {
+			t.Errorf("%s overlaps %s = %v, want %v", test.a, test.b, got, test.overlaps)
+		}
+		if got := b.overlaps(a); got != test.overlaps {
+			t.Errorf("%s overlaps %s = %v, want %v", test.b, test.a, got, test.overlaps)
+		}
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	_, err := LoadConfig("testdata/invalid.json")
+	var problems ValidationErrors
+	if !errors.As(err, &problems) {
+		t.Fatal("Expected ValidationErrors, got", err)
+	}
+	want := []string{
+		"IgnoreNets[1]",
+		"Sites[0].AllowedOrigins[1]",
+		"Sites[0].AllowedOrigins[2]",
+		"Sites[0].Contacts[0]",
+		"Sites[1].Host",
+		"Sites[1].AllowedOrigins",
+		"Sites[2].Host",
+		"Sites[2].AllowedOrigins[0]",
+		"Sites[2].AllowedOrigins[1]",
+		"Sites[2].IPMode",
+		"Sites[2].PrivacySignals",
+	}
+	if len(problems) != len(want) {
+		t.Errorf("Expected %d problems, got %d: %v", len(want), len(problems), problems)
+	}
+	for i := 0; i < len(want) && i < len(problems); i++ {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_MailConfig(t *testing.T) {
+	t.Setenv("TEST_DB_URL", "file::memory:")
+	t.Setenv("TEST_HASH_SECRET", "s3cret")
+	t.Setenv("TEST_MAIL_DOMAIN", "test.com")
+	t.Setenv("SMTP_HOST", "legacy.test.com")
+	t.Setenv("SMTP_PASS", "legacy")
+
+	conf, err := LoadConfig("testdata/mail.json")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if conf.DatabaseUrl != "file::memory:" || conf.IPHashSecret != "s3cret" {
+		t.Errorf("Expected environment references to be replaced, got %q and %q", conf.DatabaseUrl, conf.IPHashSecret)
+	}
+	// The config file and PasswordFile take precedence over the environment.
+	want := MailConfig{Host: "smtp.test.com", Port: "587", User: "metrics", Password: "sekrit", PasswordFile: "testdata/mailpass"}
+	if conf.Mail != want {
+		t.Errorf("Expected %+v, got %+v", want, conf.Mail)
+	}
+	if conf.Mail.Addr() != "smtp.test.com:587" {
+		t.Error("Expected smtp.test.com:587, got", conf.Mail.Addr())
+	}
+
+	// Without a Mail section, the legacy variables are used.
+	t.Setenv("SMTP_PORT", "25")
+	conf, err = LoadConfig("testdata/goodconfig.json")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	want = MailConfig{Host: "legacy.test.com", Port: "25", Password: "legacy"}
+	if conf.Mail != want {
+		t.Errorf("Expected %+v, got %+v", want, conf.Mail)
+	}
+	t.Setenv("SMTP_PASS_FILE", "testdata/mailpass")
+	conf, err = LoadConfig("testdata/goodconfig.json")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if conf.Mail.Password != "sekrit" {
+		t.Error("Expected password from SMTP_PASS_FILE, got", conf.Mail.Password)
+	}
+	t.Setenv("SMTP_PASS_FILE", "testdata/doesnotexist")
+	if _, err = LoadConfig("testdata/goodconfig.json"); err == nil {
+		t.Error("Expected error for missing SMTP_PASS_FILE, got nil")
+	}
+
+	t.Setenv("SMTP_PORT", "")
+	_, err = LoadConfig("testdata/badmail.json")
+	var problems ValidationErrors
+	if !errors.As(err, &problems) {
+		t.Fatal("Expected ValidationErrors, got", err)
+	}
+	paths := []string{
+		"Sites[0].AllowedOrigins[0]", // TEST_UNSET_ORIGIN is not set
+		"Mail.Password",
+		"Mail.Port",
+		"Sites[0].AllowedOrigins[0]", // and so the origin is invalid
+	}
+	if len(problems) != len(paths) {
+		t.Errorf("Expected %d problems, got %d: %v", len(paths), len(problems), problems)
+	}
+	for i := 0; i < len(paths) && i < len(problems); i++ {
+		if problems[i].Path != paths[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, paths[i], problems[i])
+		}
+	}
 }
 
 func Test_IsIgnoredIP(t *testing.T) {
@@ -102,3 +371,458 @@ func Test_HostContacts(t *testing.T) {
 		t.Error("Expected no contacts, got: ", contacts)
 	}
 }
+
+func Test_IgnoreReason(t *testing.T) {
+	conf := Config{
+		Sites: []MonitoredSite{
+			{
+				Host:             "test.com",
+				AllowedOrigins:   []string{"http://test.com"},
+				IgnoreNets:       []string{"172.16.0.0/12"},
+				IgnorePaths:      []string{"/admin/*", "/preview*", "*.php"},
+				IgnoreUserAgents: []string{"*headlesschrome*", "curl/*"},
+			},
+			{Host: "another.com", AllowedOrigins: []string{"http://test2.com"}},
+		},
+		IgnoreNets: []string{"10.10.11.0/24"},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0"
+	tests := []struct {
+		host string
+		ip   string
+		page string
+		ua   string
+		want IgnoreReason
+	}{
+		{"test.com", "10.10.10.10", "http://test.com/", firefox, IGNORE_NONE},
+		{"test.com", "10.10.11.10", "http://test.com/", firefox, IGNORE_NET},
+		{"another.com", "10.10.11.10", "http://test2.com/", firefox, IGNORE_NET},
+		{"test.com", "172.20.1.1", "http://test.com/", firefox, IGNORE_NET},
+		{"another.com", "172.20.1.1", "http://test2.com/", firefox, IGNORE_NONE},
+		{"test.com", "10.10.10.10", "http://test.com/admin/users/1?x=y", firefox, IGNORE_PATH},
+		{"test.com", "10.10.10.10", "http://test.com/admin", firefox, IGNORE_NONE},
+		{"test.com", "10.10.10.10", "http://test.com/previews/", firefox, IGNORE_PATH},
+		{"test.com", "10.10.10.10", "http://test.com/x/index.php", firefox, IGNORE_PATH},
+		{"test.com", "10.10.10.10", "/admin/", firefox, IGNORE_PATH},
+		{"another.com", "10.10.10.10", "http://test2.com/admin/", firefox, IGNORE_NONE},
+		{"test.com", "10.10.10.10", "http://test.com/", "Mozilla/5.0 HeadlessChrome/120.0", IGNORE_USER_AGENT},
+		{"test.com", "10.10.10.10", "http://test.com/", "curl/8.5.0", IGNORE_USER_AGENT},
+		{"test.com", "10.10.10.10", "http://test.com/", "libcurl/8.5.0", IGNORE_NONE},
+	}
+	for _, tt := range tests {
+		if got := conf.IgnoreReason(tt.host, tt.ip, tt.page, tt.ua); got != tt.want {
+			t.Errorf("IgnoreReason(%s, %s, %s, %s): expected %q, got %q", tt.host, tt.ip, tt.page, tt.ua, tt.want, got)
+		}
+	}
+
+	conf.Sites[0].IgnoreNets = []string{"172.16.0.0"}
+	conf.Sites[0].IgnorePaths = []string{"admin/*"}
+	conf.Sites[0].IgnoreUserAgents = []string{""}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{"Sites[0].IgnoreNets[0]", "Sites[0].IgnorePaths[0]", "Sites[0].IgnoreUserAgents[0]"}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_CanView(t *testing.T) {
+	conf := Config{
+		Sites: []MonitoredSite{
+			{Host: "test.com", AllowedOrigins: []string{"http://test.com"}},
+			{Host: "another.com", AllowedOrigins: []string{"http://test2.com"}},
+		},
+	}
+	alice := Identity{User: "alice@example.com"}
+	bob := Identity{User: "bob@example.com"}
+	monitor := Identity{Tags: []string{"tag:prod", "tag:monitoring"}}
+	if !conf.CanView(bob, "*") {
+		t.Error("Expected everyone to view everything without Access rules")
+	}
+
+	conf.Groups = map[string][]string{"group:eng": {"bob@example.com"}}
+	conf.Access = []AccessRule{
+		{Who: []string{"alice@example.com", "tag:monitoring"}, Sites: []string{"*"}},
+		{Who: []string{"group:eng"}, Sites: []string{"test.com"}},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	tests := []struct {
+		id   Identity
+		host string
+		want bool
+	}{
+		{alice, "*", true},
+		{alice, "another.com", true},
+		{monitor, "*", true},
+		{bob, "test.com", true},
+		{bob, "another.com", false},
+		{bob, "*", false},
+		{Identity{User: "eve@example.com"}, "test.com", false},
+		{Identity{}, "test.com", false},
+		{Identity{Tags: []string{"tag:prod"}}, "test.com", false},
+	}
+	for _, tt := range tests {
+		if got := conf.CanView(tt.id, tt.host); got != tt.want {
+			t.Errorf("CanView(%s, %s): expected %v, got %v", tt.id, tt.host, tt.want, got)
+		}
+	}
+	if sites := conf.VisibleSites(bob); len(sites) != 1 || sites[0].Host != "test.com" {
+		t.Error("Expected bob to see only test.com, got", sites)
+	}
+
+	conf.Groups["eng"] = []string{"carol"}
+	conf.Access = []AccessRule{
+		{Who: []string{"group:ops", "tag:", "alice"}, Sites: []string{"unknown.com"}},
+		{},
+	}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{
+		"Groups.eng",
+		"Groups.eng[0]",
+		"Access[0].Who[0]",
+		"Access[0].Who[1]",
+		"Access[0].Who[2]",
+		"Access[0].Sites[0]",
+		"Access[1].Who",
+		"Access[1].Sites",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_AdminConfig(t *testing.T) {
+	admin := AdminConfig{
+		Mode:   ADMIN_LOCAL,
+		Listen: "unix:/run/metrics/admin.sock",
+		Users: []AdminUser{
+			{Name: "ops", Token: "t1"},
+			{Name: "viewer", Password: "pw", Token: "t2"},
+		},
+	}
+	if network, addr := admin.Network(); network != "unix" || addr != "/run/metrics/admin.sock" {
+		t.Errorf("Expected unix socket, got %s %s", network, addr)
+	}
+	if user, ok := admin.UserForToken("t2"); !ok || user.Name != "viewer" {
+		t.Error("Expected t2 to authenticate viewer, got", user, ok)
+	}
+	if _, ok := admin.UserForToken(""); ok {
+		t.Error("Expected empty token not to authenticate")
+	}
+	if _, ok := admin.UserForPassword("ops", ""); ok {
+		t.Error("Expected empty password not to authenticate ops")
+	}
+	if user, ok := admin.UserForPassword("viewer", "pw"); !ok || user.Name != "viewer" {
+		t.Error("Expected password to authenticate viewer, got", user, ok)
+	}
+
+	conf := Config{Admin: admin, Access: []AccessRule{{Who: []string{"ops"}, Sites: []string{"*"}}}}
+	if err := conf.Validate(); err != nil {
+		t.Error("Expected no error, got", err)
+	}
+	conf.Admin = AdminConfig{
+		Mode:  ADMIN_LOCAL,
+		Users: []AdminUser{{Name: "ops", Token: "t"}, {Name: "ops", Token: "t"}, {}},
+	}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{
+		"Admin.Listen",
+		"Admin.Users[1].Name",
+		"Admin.Users[1].Token",
+		"Admin.Users[2].Name",
+		"Admin.Users[2]",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_SpamConfig(t *testing.T) {
+	spam := SpamConfig{}
+	if spam.ThresholdOrDefault() != DEFAULT_SPAM_THRESHOLD || spam.MaxLinksOrDefault() != DEFAULT_SPAM_MAX_LINKS || spam.MinSubmitDelay() != DEFAULT_MIN_SUBMIT_DELAY {
+		t.Errorf("Expected defaults, got %d, %d, %s", spam.ThresholdOrDefault(), spam.MaxLinksOrDefault(), spam.MinSubmitDelay())
+	}
+	spam = SpamConfig{Threshold: 8, MaxLinks: 5, MinSubmitSeconds: 10}
+	if spam.ThresholdOrDefault() != 8 || spam.MaxLinksOrDefault() != 5 || spam.MinSubmitDelay() != 10*time.Second {
+		t.Errorf("Expected configured values, got %d, %d, %s", spam.ThresholdOrDefault(), spam.MaxLinksOrDefault(), spam.MinSubmitDelay())
+	}
+	if spam = (SpamConfig{MaxLinks: -1}); spam.MaxLinksOrDefault() != 0 {
+		t.Errorf("Expected no links allowed, got %d", spam.MaxLinksOrDefault())
+	}
+
+	conf := Config{Sites: []MonitoredSite{
+		{Host: "a.com", AllowedOrigins: []string{"https://a.com"}, Spam: SpamConfig{RequireToken: true, ProofOfWorkBits: 16}},
+		{Host: "b.com", AllowedOrigins: []string{"https://b.com"}, Spam: SpamConfig{
+			Threshold:        -1,
+			MaxLinks:         -2,
+			BlockedKeywords:  []string{"ok", ""},
+			MinSubmitSeconds: -1,
+			ProofOfWorkBits:  8,
+		}},
+		{Host: "c.com", AllowedOrigins: []string{"https://c.com"}, Spam: SpamConfig{RequireToken: true, ProofOfWorkBits: 99}},
+	}}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{
+		"Sites[1].Spam.Threshold",
+		"Sites[1].Spam.MaxLinks",
+		"Sites[1].Spam.BlockedKeywords[1]",
+		"Sites[1].Spam.MinSubmitSeconds",
+		"Sites[1].Spam.ProofOfWorkBits",
+		"Sites[2].Spam.ProofOfWorkBits",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_ContactFormConfig(t *testing.T) {
+	if fields := (MonitoredSite{}).ContactFormFields(); len(fields) != len(DEFAULT_CONTACT_FORM) || fields[3].Name != "msg" {
+		t.Errorf("Expected the default form, got %+v", fields)
+	}
+	tests := []struct {
+		field FormField
+		value any
+		want  string
+		err   bool
+	}{
+		{FormField{Name: "name"}, "Jo", "Jo", false},
+		{FormField{Name: "name"}, nil, "", false},
+		{FormField{Name: "name", Required: true}, " ", "", true},
+		{FormField{Name: "name"}, true, "", true},
+		{FormField{Name: "name", MaxLength: 3}, "Zoë", "Zoë", false},
+		{FormField{Name: "name", MaxLength: 3}, "Zoë!", "", true},
+		{FormField{Name: "email", Type: FIELD_EMAIL}, "jo@example.com", "jo@example.com", false},
+		{FormField{Name: "email", Type: FIELD_EMAIL}, "jo at example", "", true},
+		{FormField{Name: "phone", Type: FIELD_PHONE}, "+64 (21) 555-1234", "+64 (21) 555-1234", false},
+		{FormField{Name: "phone", Type: FIELD_PHONE}, "call me", "", true},
+		{FormField{Name: "budget", Type: FIELD_NUMBER}, json.Number("1500.50"), "1500.50", false},
+		{FormField{Name: "budget", Type: FIELD_NUMBER}, "lots", "", true},
+		{FormField{Name: "topic", Type: FIELD_SELECT, Options: []string{"Sales", "Support"}}, "Support", "Support", false},
+		{FormField{Name: "topic", Type: FIELD_SELECT, Options: []string{"Sales", "Support"}}, "support", "", true},
+		{FormField{Name: "consent", Type: FIELD_CHECKBOX}, nil, "no", false},
+		{FormField{Name: "consent", Type: FIELD_CHECKBOX}, "on", "yes", false},
+		{FormField{Name: "consent", Type: FIELD_CHECKBOX}, "maybe", "", true},
+		{FormField{Name: "consent", Type: FIELD_CHECKBOX, Required: true}, true, "yes", false},
+		{FormField{Name: "consent", Type: FIELD_CHECKBOX, Required: true}, false, "", true},
+	}
+	for i, test := range tests {
+		got, err := test.field.Value(test.value)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("Test %d: expected %q (error %v), got %q, %v", i, test.want, test.err, got, err)
+		}
+	}
+
+	conf := Config{Sites: []MonitoredSite{
+		{Host: "a.com", AllowedOrigins: []string{"https://a.com"}, ContactForm: []FormField{
+			{Name: "email", Type: FIELD_EMAIL, Required: true},
+			{Name: "topic", Type: FIELD_SELECT, Options: []string{"Sales"}},
+		}},
+		{Host: "b.com", AllowedOrigins: []string{"https://b.com"}, ContactForm: []FormField{
+			{Label: "Unnamed"},
+			{Name: "Token"},
+			{Name: "email", Type: "date", MaxLength: -1},
+			{Name: "Email"},
+			{Name: "topic", Type: FIELD_SELECT},
+			{Name: "colour", Options: []string{"Red"}},
+		}},
+	}}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{
+		"Sites[1].ContactForm[0].Name",
+		"Sites[1].ContactForm[1].Name",
+		"Sites[1].ContactForm[2].Type",
+		"Sites[1].ContactForm[2].MaxLength",
+		"Sites[1].ContactForm[3].Name",
+		"Sites[1].ContactForm[4].Options",
+		"Sites[1].ContactForm[5].Options",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_ContactMailConfig(t *testing.T) {
+	m := ContactMailConfig{}
+	if m.FromAddress().Address != DEFAULT_CONTACT_FROM || m.SubjectTemplate() != DEFAULT_CONTACT_SUBJECT {
+		t.Errorf("Expected defaults, got %v, %q", m.FromAddress(), m.SubjectTemplate())
+	}
+	if m.AutoReply.SubjectTemplate() != DEFAULT_AUTOREPLY_SUBJECT || m.AutoReply.RateLimit() != DEFAULT_AUTOREPLY_RATE_LIMIT {
+		t.Errorf("Expected auto-reply defaults, got %q, %s", m.AutoReply.SubjectTemplate(), m.AutoReply.RateLimit())
+	}
+	if m.AutoReply.MaxPerIPOrDefault() != DEFAULT_AUTOREPLY_MAX_PER_IP || m.AutoReply.MaxPerHourOrDefault() != DEFAULT_AUTOREPLY_MAX_HOURLY {
+		t.Errorf("Expected auto-reply limit defaults, got %d, %d", m.AutoReply.MaxPerIPOrDefault(), m.AutoReply.MaxPerHourOrDefault())
+	}
+	if a := (AutoReplyConfig{RateLimitHours: 2, MaxPerIP: 1, MaxPerHour: 5}); a.RateLimit() != 2*time.Hour || a.MaxPerIPOrDefault() != 1 || a.MaxPerHourOrDefault() != 5 {
+		t.Errorf("Expected configured rate limits, got %s, %d, %d", a.RateLimit(), a.MaxPerIPOrDefault(), a.MaxPerHourOrDefault())
+	}
+	m = ContactMailConfig{From: "Web Site <web@test.com>", Subject: "Hi"}
+	if from := m.FromAddress(); from.Name != "Web Site" || from.Address != "web@test.com" || m.SubjectTemplate() != "Hi" {
+		t.Errorf("Expected configured values, got %v, %q", from, m.SubjectTemplate())
+	}
+
+	conf := Config{Sites: []MonitoredSite{
+		{Host: "a.com", AllowedOrigins: []string{"https://a.com"}, ContactMail: ContactMailConfig{
+			From:         "web@a.com",
+			Subject:      "Enquiry from {{.Event.Name}}",
+			TextTemplate: "testdata/contact.tmpl",
+			HTMLTemplate: "testdata/contact.html",
+		}},
+		{Host: "b.com", AllowedOrigins: []string{"https://b.com"}, ContactMail: ContactMailConfig{
+			From:         "not an address",
+			Subject:      "{{.Event.Name",
+			TextTemplate: "testdata/badcontact.tmpl",
+			HTMLTemplate: "testdata/missing.html",
+			AutoReply: AutoReplyConfig{
+				Enabled:        true,
+				TextTemplate:   "testdata/badcontact.tmpl",
+				RateLimitHours: -1,
+				MaxPerIP:       -1,
+				MaxPerHour:     -1,
+			},
+		}},
+	}}
+	var problems ValidationErrors
+	if !errors.As(conf.Validate(), &problems) {
+		t.Fatal("Expected ValidationErrors")
+	}
+	want := []string{
+		"Sites[1].ContactMail.From",
+		"Sites[1].ContactMail.Subject",
+		"Sites[1].ContactMail.TextTemplate",
+		"Sites[1].ContactMail.HTMLTemplate",
+		"Sites[1].ContactMail.AutoReply.TextTemplate",
+		"Sites[1].ContactMail.AutoReply.RateLimitHours",
+		"Sites[1].ContactMail.AutoReply.MaxPerIP",
+		"Sites[1].ContactMail.AutoReply.MaxPerHour",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %v", len(want), problems)
+	}
+	for i := range want {
+		if problems[i].Path != want[i] {
+			t.Errorf("Problem %d: expected path %s, got %s", i, want[i], problems[i])
+		}
+	}
+}
+
+func Test_AnonymiseIP(t *testing.T) {
+	conf := Config{
+		Sites: []MonitoredSite{
+			{Host: "full.com"},
+			{Host: "truncate.com", IPMode: IP_TRUNCATE},
+			{Host: "hash.com", IPMode: IP_HASH},
+			{Host: "drop.com", IPMode: IP_DROP},
+		},
+		IPHashSecret: "secret",
+	}
+	tests := []struct {
+		host string
+		ip   string
+		want string
+	}{
+		{"full.com", "10.10.10.10", "10.10.10.10"},
+		{"unknown.com", "10.10.10.10", "10.10.10.10"},
+		{"truncate.com", "10.10.10.10", "10.10.10.0"},
+		{"truncate.com", "2001:db8:1:2:3:4:5:6", "2001:db8:1::"},
+		{"truncate.com", "not-an-ip", "not-an-ip"},
+		{"drop.com", "10.10.10.10", ""},
+	}
+	for _, test := range tests {
+		if got := conf.AnonymiseIP(test.host, test.ip); got != test.want {
+			t.Errorf("AnonymiseIP(%s, %s) = %s, want %s", test.host, test.ip, got, test.want)
+		}
+	}
+
+	hashed := conf.AnonymiseIP("hash.com", "10.10.10.10")
+	if hashed == "10.10.10.10" || hashed == "" {
+		t.Error("Expected IP to be hashed, got", hashed)
+	}
+	if again := conf.AnonymiseIP("hash.com", "10.10.10.10"); again != hashed {
+		t.Errorf("Expected stable hash, got %s and %s", hashed, again)
+	}
+	if rehashed := conf.AnonymiseIP("hash.com", hashed); rehashed != hashed {
+		t.Errorf("Expected hashed IP to be left alone, got %s", rehashed)
+	}
+	conf.IPHashSecret = "other"
+	if other := conf.AnonymiseIP("hash.com", "10.10.10.10"); other == hashed {
+		t.Error("Expected hash to depend on the secret")
+	}
+
+	_, err := LoadConfig("testdata/badipmode.json")
+	if err == nil {
+		t.Error("Expected error for hash IPMode without secret, got nil")
+	}
+}
+
+func Test_SiteChanges(t *testing.T) {
+	old := Config{Sites: []MonitoredSite{
+		{Host: "same.com", AllowedOrigins: []string{"http://same.com"}},
+		{Host: "changed.com", AllowedOrigins: []string{"http://changed.com"}},
+		{Host: "removed.com"},
+	}}
+	newer := Config{Sites: []MonitoredSite{
+		{Host: "same.com", AllowedOrigins: []string{"http://same.com"}},
+		{Host: "changed.com", AllowedOrigins: []string{"http://changed.com", "https://changed.com"}},
+		{Host: "added.com"},
+	}}
+	added, removed, changed := old.SiteChanges(newer)
+	if len(added) != 1 || added[0] != "added.com" {
+		t.Error("Expected added.com to be added, got", added)
+	}
+	if len(removed) != 1 || removed[0] != "removed.com" {
+		t.Error("Expected removed.com to be removed, got", removed)
+	}
+	if len(changed) != 1 || changed[0] != "changed.com" {
+		t.Error("Expected changed.com to be changed, got", changed)
+	}
+}
+
+// Returns just the host matching origin.
+func matchHost(conf Config, origin string) string {
+	site, _ := conf.GetHostForOrigin(origin)
+	return site.Host
+}
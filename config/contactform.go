@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The kind of value a contact form field holds.
+type FieldType string
+
+const (
+	FIELD_TEXT     FieldType = ""         // A single line of text.
+	FIELD_TEXTAREA FieldType = "textarea" // Free text, such as the message.
+	FIELD_EMAIL    FieldType = "email"    // An email address, see FormField.
+	FIELD_PHONE    FieldType = "phone"
+	FIELD_NUMBER   FieldType = "number"
+	FIELD_SELECT   FieldType = "select"   // One of the field's Options.
+	FIELD_CHECKBOX FieldType = "checkbox" // true or false, e.g. consent.
+)
+
+func (t FieldType) validate() error {
+	switch t {
+	case FIELD_TEXT, FIELD_TEXTAREA, FIELD_EMAIL, FIELD_PHONE, FIELD_NUMBER, FIELD_SELECT, FIELD_CHECKBOX:
+		return nil
+	}
+	return fmt.Errorf("unknown field type %q", t)
+}
+
+// Defaults for FormField.
+const DEFAULT_FIELD_MAX_LENGTH = 10000
+
+// Names used by the contact form for its spam defences, see SpamConfig.
+var reservedFieldNames = []string{"website", "token", "proof"}
+
+// The form used by sites which don't configure ContactForm.
+var DEFAULT_CONTACT_FORM = []FormField{
+	{Name: "name", Label: "Name"},
+	{Name: "org", Label: "Org"},
+	{Name: "details", Label: "Contact Details"},
+	{Name: "msg", Label: "Message", Type: FIELD_TEXTAREA},
+}
+
+// A field of a site's contact form, submitted as a JSON property named Name
+// (matched case insensitively).
+//
+// The first FIELD_EMAIL field, or failing that a "details" field holding an
+// address, is where replies and any auto-reply are sent. Fields named name,
+// org, details and msg are also stored in the MailLog columns of those names.
+type FormField struct {
+	Name string
+	// Shown in the email, defaults to Name.
+	Label    string
+	Type     FieldType
+	Required bool
+	// Maximum length in characters, defaults to DEFAULT_FIELD_MAX_LENGTH.
+	MaxLength int
+	// The values a FIELD_SELECT may have.
+	Options []string
+}
+
+// Returns the configured Label, or its default.
+func (f FormField) LabelOrDefault() string {
+	if f.Label == "" {
+		return f.Name
+	}
+	return f.Label
+}
+
+// Returns the configured MaxLength, or its default.
+func (f FormField) MaxLengthOrDefault() int {
+	if f.MaxLength == 0 {
+		return DEFAULT_FIELD_MAX_LENGTH
+	}
+	return f.MaxLength
+}
+
+var phoneRe = regexp.MustCompile(`^\+?[0-9 ().-]*[0-9][0-9 ().-]*$`)
+
+// Returns v, a submitted value (decoded from JSON, with numbers as
+// json.Number) or nil if it wasn't submitted, as it is to be stored, or an
+// error describing why it isn't valid for f.
+func (f FormField) Value(v any) (string, error) {
+	var s string
+	switch v := v.(type) {
+	case nil:
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		if f.Type != FIELD_CHECKBOX {
+			return "", fmt.Errorf("must be text")
+		}
+		s = strconv.FormatBool(v)
+	default:
+		return "", fmt.Errorf("must be text")
+	}
+
+	if f.Type == FIELD_CHECKBOX {
+		// As submitted by an HTML form, or JSON.
+		checked := s == "on"
+		if s != "" && s != "on" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return "", fmt.Errorf("must be true or false")
+			}
+			checked = b
+		}
+		if f.Required && !checked {
+			return "", fmt.Errorf("is required")
+		}
+		if checked {
+			return "yes", nil
+		}
+		return "no", nil
+	}
+
+	if strings.TrimSpace(s) == "" {
+		if f.Required {
+			return "", fmt.Errorf("is required")
+		}
+		return s, nil
+	}
+	if max := f.MaxLengthOrDefault(); utf8.RuneCountInString(s) > max {
+		return "", fmt.Errorf("must be at most %d characters", max)
+	}
+	switch f.Type {
+	case FIELD_EMAIL:
+		if _, err := mail.ParseAddress(s); err != nil {
+			return "", fmt.Errorf("must be an email address")
+		}
+	case FIELD_PHONE:
+		if !phoneRe.MatchString(strings.TrimSpace(s)) {
+			return "", fmt.Errorf("must be a phone number")
+		}
+	case FIELD_NUMBER:
+		if _, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+			return "", fmt.Errorf("must be a number")
+		}
+	case FIELD_SELECT:
+		if !slices.Contains(f.Options, s) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(f.Options, ", "))
+		}
+	}
+	return s, nil
+}
+
+// Returns the fields of the site's contact form.
+func (s MonitoredSite) ContactFormFields() []FormField {
+	if len(s.ContactForm) == 0 {
+		return DEFAULT_CONTACT_FORM
+	}
+	return s.ContactForm
+}
+
+func validateContactForm(path string, fields []FormField, errs *ValidationErrors) {
+	names := make(map[string]bool)
+	for i, f := range fields {
+		fpath := fmt.Sprintf("%s[%d]", path, i)
+		name := strings.ToLower(f.Name)
+		if f.Name == "" {
+			errs.add(fpath+".Name", "must be set")
+		} else if slices.Contains(reservedFieldNames, name) {
+			errs.add(fpath+".Name", "%s is used by the spam defences", f.Name)
+		} else if names[name] {
+			errs.add(fpath+".Name", "%s is already configured", f.Name)
+		}
+		names[name] = true
+		if err := f.Type.validate(); err != nil {
+			errs.add(fpath+".Type", "%v", err)
+		}
+		if f.MaxLength < 0 {
+			errs.add(fpath+".MaxLength", "must not be negative")
+		}
+		if f.Type == FIELD_SELECT && len(f.Options) == 0 {
+			errs.add(fpath+".Options", "must be set for a select field")
+		} else if f.Type != FIELD_SELECT && len(f.Options) > 0 {
+			errs.add(fpath+".Options", "only apply to select fields")
+		}
+	}
+}
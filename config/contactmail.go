@@ -0,0 +1,149 @@
+package config
+
+import (
+	htmltemplate "html/template"
+	"net/mail"
+	"text/template"
+	"time"
+)
+
+// Defaults for ContactMailConfig.
+const (
+	// Must be mkmba.nz until SES is out of sandbox.
+	DEFAULT_CONTACT_FROM    = "web-contact@mkmba.nz"
+	DEFAULT_CONTACT_SUBJECT = "Contact form submission from {{.Event.Host}}"
+
+	DEFAULT_AUTOREPLY_SUBJECT    = "Thanks for contacting {{.Event.Host}}"
+	DEFAULT_AUTOREPLY_RATE_LIMIT = 24 * time.Hour
+	DEFAULT_AUTOREPLY_MAX_PER_IP = 3
+	DEFAULT_AUTOREPLY_MAX_HOURLY = 20
+)
+
+// How a site's contact form submissions are emailed to its Contacts.
+//
+// Subject and the templates are given the same data as the built in
+// contactform.tmpl and contactform.html templates.
+type ContactMailConfig struct {
+	// Sender address (e.g. "Website <web@example.com>"), defaults to
+	// DEFAULT_CONTACT_FROM.
+	From string
+	// text/template for the subject, defaults to DEFAULT_CONTACT_SUBJECT.
+	Subject string
+	// Paths to a text/template for the plain text body, and an html/template
+	// for the HTML alternative, replacing the built in templates.
+	TextTemplate string
+	HTMLTemplate string
+
+	AutoReply AutoReplyConfig
+}
+
+// An acknowledgement emailed (from ContactMail.From) to people submitting the
+// contact form, if they give an email address as their contact details.
+//
+// Anyone can enter anyone's address, so at most one is sent to each address,
+// and MaxPerIP to submissions from each IP, every RateLimitHours, and at most
+// MaxPerHour are sent for the site. The built in templates don't include
+// anything submitted (the message, or the submitter's name) so the content of
+// replies can't be chosen by spammers; take care that replacement templates
+// don't either.
+type AutoReplyConfig struct {
+	Enabled bool
+	// text/template for the subject, defaults to DEFAULT_AUTOREPLY_SUBJECT.
+	Subject string
+	// Paths to templates replacing the built in autoreply.tmpl and
+	// autoreply.html, as for ContactMailConfig.
+	TextTemplate string
+	HTMLTemplate string
+	// Defaults to DEFAULT_AUTOREPLY_RATE_LIMIT.
+	RateLimitHours int
+	// Default to DEFAULT_AUTOREPLY_MAX_PER_IP and DEFAULT_AUTOREPLY_MAX_HOURLY.
+	MaxPerIP   int
+	MaxPerHour int
+}
+
+// Returns the Subject template, or its default.
+func (a AutoReplyConfig) SubjectTemplate() string {
+	if a.Subject == "" {
+		return DEFAULT_AUTOREPLY_SUBJECT
+	}
+	return a.Subject
+}
+
+// Returns the minimum time between replies to the same address.
+func (a AutoReplyConfig) RateLimit() time.Duration {
+	if a.RateLimitHours == 0 {
+		return DEFAULT_AUTOREPLY_RATE_LIMIT
+	}
+	return time.Duration(a.RateLimitHours) * time.Hour
+}
+
+// Returns the configured MaxPerIP, or its default.
+func (a AutoReplyConfig) MaxPerIPOrDefault() int {
+	if a.MaxPerIP == 0 {
+		return DEFAULT_AUTOREPLY_MAX_PER_IP
+	}
+	return a.MaxPerIP
+}
+
+// Returns the configured MaxPerHour, or its default.
+func (a AutoReplyConfig) MaxPerHourOrDefault() int {
+	if a.MaxPerHour == 0 {
+		return DEFAULT_AUTOREPLY_MAX_HOURLY
+	}
+	return a.MaxPerHour
+}
+
+// Returns the From address, or its default.
+func (m ContactMailConfig) FromAddress() *mail.Address {
+	addr, err := mail.ParseAddress(m.From)
+	if err != nil { // Not set, as it was validated.
+		return &mail.Address{Address: DEFAULT_CONTACT_FROM}
+	}
+	return addr
+}
+
+// Returns the Subject template, or its default.
+func (m ContactMailConfig) SubjectTemplate() string {
+	if m.Subject == "" {
+		return DEFAULT_CONTACT_SUBJECT
+	}
+	return m.Subject
+}
+
+func (m ContactMailConfig) validate(path string, errs *ValidationErrors) {
+	if m.From != "" {
+		if _, err := mail.ParseAddress(m.From); err != nil {
+			errs.add(path+".From", "invalid address %q: %v", m.From, err)
+		}
+	}
+	validateTemplates(path, m.SubjectTemplate(), m.TextTemplate, m.HTMLTemplate, errs)
+	a := m.AutoReply
+	validateTemplates(path+".AutoReply", a.SubjectTemplate(), a.TextTemplate, a.HTMLTemplate, errs)
+	if a.RateLimitHours < 0 {
+		errs.add(path+".AutoReply.RateLimitHours", "must not be negative")
+	}
+	if a.MaxPerIP < 0 {
+		errs.add(path+".AutoReply.MaxPerIP", "must not be negative")
+	}
+	if a.MaxPerHour < 0 {
+		errs.add(path+".AutoReply.MaxPerHour", "must not be negative")
+	}
+}
+
+// Checks the Subject template, and the TextTemplate and HTMLTemplate files,
+// of the mail config at path parse.
+func validateTemplates(path, subject, text, html string, errs *ValidationErrors) {
+	if _, err := template.New("subject").Parse(subject); err != nil {
+		errs.add(path+".Subject", "%v", err)
+	}
+	if text != "" {
+		if _, err := template.ParseFiles(text); err != nil {
+			errs.add(path+".TextTemplate", "%v", err)
+		}
+	}
+	if html != "" {
+		if _, err := htmltemplate.ParseFiles(html); err != nil {
+			errs.add(path+".HTMLTemplate", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package config
+
+import "sync/atomic"
+
+// The config in use, shared by all packages and replaced as a whole on reload.
+var current atomic.Pointer[Config]
+
+// Returns the current config.
+//
+// Callers handling a request should call this once and use the returned value
+// throughout, so that a concurrent reload can't give them a mix of old and new
+// settings.
+func Current() Config {
+	if c := current.Load(); c != nil {
+		return *c
+	}
+	return Config{}
+}
+
+// Replaces the current config.
+func Set(c Config) {
+	current.Store(&c)
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Matches ${VAR} references to environment variables.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replaces ${VAR} in every string of the config with the value of the
+// environment variable VAR. References to unset variables are reported as
+// errors, rather than silently becoming empty.
+func (c *Config) interpolateEnv() (errs ValidationErrors) {
+	interpolateValue(reflect.ValueOf(c).Elem(), "", &errs)
+	return errs
+}
+
+func interpolateValue(v reflect.Value, path string, errs *ValidationErrors) {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if !strings.Contains(s, "${") {
+			return
+		}
+		v.SetString(envRef.ReplaceAllStringFunc(s, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				errs.add(path, "environment variable %s is not set", name)
+			}
+			return value
+		}))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			fpath := f.Name
+			if path != "" {
+				fpath = path + "." + f.Name
+			}
+			interpolateValue(v.Field(i), fpath, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			interpolateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+// Reads a secret from filename, without any trailing newline.
+func readSecret(filename string) (string, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, chosen by the file's extension.
+const (
+	FORMAT_JSON   = "json"   // .json, or any extension not listed below
+	FORMAT_HUJSON = "hujson" // .hujson or .jsonc: JSON with comments and trailing commas
+	FORMAT_YAML   = "yaml"   // .yaml or .yml
+)
+
+// Returns the format of the config file filename.
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hujson", ".jsonc":
+		return FORMAT_HUJSON
+	case ".yaml", ".yml":
+		return FORMAT_YAML
+	}
+	return FORMAT_JSON
+}
+
+// Line numbers of the values in a config file, keyed by lower-cased
+// ValidationError path, e.g. sites[1].allowedorigins[0].
+type lineIndex map[string]int
+
+// Returns the line of the value at path, or 0 if it isn't known.
+//
+// Paths not present in the file (e.g. a missing field) fall back to the line
+// of the closest enclosing value that is.
+func (l lineIndex) line(path string) int {
+	path = strings.ToLower(path)
+	for path != "" {
+		if line, ok := l[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+// Decodes the contents b of a config file in the given format.
+//
+// Field names are matched case-insensitively whatever the format, as for
+// JSON. Syntax errors are returned with the line they were found on.
+func decodeConfig(format string, b []byte) (Config, lineIndex, error) {
+	lines := make(lineIndex)
+	var data []byte
+	switch format {
+	case FORMAT_YAML:
+		var node yaml.Node
+		if err := yaml.Unmarshal(b, &node); err != nil {
+			return Config{}, nil, err
+		}
+		indexYAML(&node, "", lines)
+		var v any
+		if err := node.Decode(&v); err != nil {
+			return Config{}, nil, err
+		}
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return Config{}, nil, fmt.Errorf("yaml: %w", err)
+		}
+	case FORMAT_HUJSON:
+		v, err := hujson.Parse(b)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		indexJSON(b, v, "", lines)
+		v.Standardize()
+		data = v.Pack()
+	default:
+		data = b
+		if v, err := hujson.Parse(b); err == nil && v.IsStandard() {
+			indexJSON(b, v, "", lines)
+		}
+	}
+
+	config := Config{}
+	err := json.Unmarshal(data, &config)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr) && format == FORMAT_JSON:
+		line := 1 + bytes.Count(b[:syntaxErr.Offset], []byte("\n"))
+		return Config{}, nil, fmt.Errorf("line %d: %w", line, err)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		path := fieldPath(typeErr.Field)
+		return Config{}, nil, ValidationErrors{{
+			Path:    path,
+			Problem: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+			Line:    lines.line(path),
+		}}
+	case err != nil:
+		return Config{}, nil, err
+	}
+	return config, lines, nil
+}
+
+var fieldIndex = regexp.MustCompile(`\.(\d+)(\.|$)`)
+
+// Converts a json.UnmarshalTypeError field (sites.1.host) to a path.
+func fieldPath(field string) string {
+	// Applied twice as adjacent indexes (a.1.2) share a dot.
+	for i := 0; i < 2; i++ {
+		field = fieldIndex.ReplaceAllString(field, "[$1]$2")
+	}
+	return field
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return strings.ToLower(name)
+	}
+	return path + "." + strings.ToLower(name)
+}
+
+// Records the line of every value below v in lines.
+func indexJSON(b []byte, v hujson.Value, path string, lines lineIndex) {
+	switch value := v.Value.(type) {
+	case *hujson.Object:
+		for _, m := range value.Members {
+			name, ok := m.Name.Value.(hujson.Literal)
+			if !ok {
+				continue
+			}
+			mpath := joinPath(path, name.String())
+			lines[mpath] = 1 + bytes.Count(b[:m.Name.StartOffset], []byte("\n"))
+			indexJSON(b, m.Value, mpath, lines)
+		}
+	case *hujson.Array:
+		for i, e := range value.Elements {
+			epath := fmt.Sprintf("%s[%d]", path, i)
+			lines[epath] = 1 + bytes.Count(b[:e.StartOffset], []byte("\n"))
+			indexJSON(b, e, epath, lines)
+		}
+	}
+}
+
+// Records the line of every value below node in lines.
+func indexYAML(node *yaml.Node, path string, lines lineIndex) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			indexYAML(n, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			mpath := joinPath(path, key.Value)
+			lines[mpath] = key.Line
+			indexYAML(value, mpath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			epath := fmt.Sprintf("%s[%d]", path, i)
+			lines[epath] = n.Line
+			indexYAML(n, epath, lines)
+		}
+	case yaml.AliasNode:
+		indexYAML(node.Alias, path, lines)
+	}
+}
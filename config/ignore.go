@@ -0,0 +1,72 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Why an event is being ignored.
+type IgnoreReason string
+
+const (
+	IGNORE_NONE       IgnoreReason = ""           // Not ignored.
+	IGNORE_NET        IgnoreReason = "net"        // From an IgnoreNets network, global or per site.
+	IGNORE_PATH       IgnoreReason = "path"       // For a page matching the site's IgnorePaths.
+	IGNORE_USER_AGENT IgnoreReason = "user_agent" // From a browser matching the site's IgnoreUserAgents.
+	IGNORE_SPAM       IgnoreReason = "spam"       // A contact form submission scored as spam, see SpamConfig.
+)
+
+// Returns why an event for host from ip, on page and with User-Agent ua,
+// should be ignored, or IGNORE_NONE if it should be recorded.
+func (c Config) IgnoreReason(host, ip, page, ua string) IgnoreReason {
+	site := c.GetSite(host)
+	if c.IsIgnoredIP(ip) || containsIP(site._ignoredNets, ip) {
+		return IGNORE_NET
+	}
+	if len(site._ignorePaths) > 0 {
+		path := page
+		if u, err := url.Parse(page); err == nil && u.Path != "" {
+			path = u.Path
+		}
+		for _, re := range site._ignorePaths {
+			if re.MatchString(path) {
+				return IGNORE_PATH
+			}
+		}
+	}
+	for _, re := range site._ignoreUserAgents {
+		if re.MatchString(ua) {
+			return IGNORE_USER_AGENT
+		}
+	}
+	return IGNORE_NONE
+}
+
+func containsIP(nets []*net.IPNet, ip string) bool {
+	ipAddr := net.ParseIP(ip)
+	if ipAddr == nil {
+		return false
+	}
+	for _, net := range nets {
+		if net.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compiles a pattern in which * matches any sequence of characters (including
+// "/") and everything else is literal. The whole string must match.
+func compileGlob(pattern string, ignoreCase bool) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	re := "^" + strings.Join(parts, ".*") + "$"
+	if ignoreCase {
+		re = "(?i)" + re
+	}
+	return regexp.MustCompile(re)
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// How client IP addresses are stored for a site.
+type IPMode string
+
+const (
+	IP_FULL     IPMode = "full"     // Store the full address (the default).
+	IP_TRUNCATE IPMode = "truncate" // Zero all but the /24 (IPv4) or /48 (IPv6) prefix.
+	IP_HASH     IPMode = "hash"     // Store a keyed hash of the address.
+	IP_DROP     IPMode = "drop"     // Don't store the address at all.
+)
+
+func (m IPMode) validate() error {
+	switch m {
+	case "", IP_FULL, IP_TRUNCATE, IP_HASH, IP_DROP:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", m)
+}
+
+// Returns ip anonymised according to the IPMode of host.
+//
+// Values which don't parse as an IP address (including ones which have
+// already been hashed) are returned unchanged unless the mode is IP_DROP.
+func (c Config) AnonymiseIP(host, ip string) string {
+	mode := c.GetSite(host).IPMode
+	if mode == IP_DROP {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	switch mode {
+	case IP_TRUNCATE:
+		if v4 := addr.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return addr.Mask(net.CIDRMask(48, 128)).String()
+	case IP_HASH:
+		mac := hmac.New(sha256.New, []byte(c.IPHashSecret))
+		mac.Write([]byte(addr.String()))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return ip
+}
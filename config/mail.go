@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// Outbound (SMTP) mail settings for contact form submissions.
+//
+// Each setting is taken from the first of these that is set:
+//
+//  1. The value in the config file (which may use ${ENV} references).
+//  2. For Password only, the contents of PasswordFile.
+//  3. The legacy environment variables: SMTP_HOST, SMTP_PORT, SMTP_USER, and
+//     for the password the contents of the file named by SMTP_PASS_FILE, then
+//     SMTP_PASS.
+type MailConfig struct {
+	Host         string
+	Port         string
+	User         string
+	Password     string
+	PasswordFile string
+}
+
+// Returns the address (host:port) of the SMTP server.
+func (m MailConfig) Addr() string {
+	return m.Host + ":" + m.Port
+}
+
+// Applies the fallbacks documented on MailConfig.
+func (m *MailConfig) resolve() (errs ValidationErrors) {
+	envDefault := func(field *string, env string) {
+		if *field == "" {
+			*field = os.Getenv(env)
+		}
+	}
+	envDefault(&m.Host, "SMTP_HOST")
+	envDefault(&m.Port, "SMTP_PORT")
+	envDefault(&m.User, "SMTP_USER")
+
+	if m.Password != "" && m.PasswordFile != "" {
+		errs.add("Mail.Password", "only one of Password and PasswordFile may be set")
+	}
+	passwordFile, path := m.PasswordFile, "Mail.PasswordFile"
+	if m.Password == "" && passwordFile == "" {
+		passwordFile, path = os.Getenv("SMTP_PASS_FILE"), "SMTP_PASS_FILE"
+	}
+	if m.Password == "" && passwordFile != "" {
+		secret, err := readSecret(passwordFile)
+		if err != nil {
+			errs.add(path, "could not read password: %v", err)
+		}
+		m.Password = secret
+	}
+	envDefault(&m.Password, "SMTP_PASS")
+
+	if m.Port != "" {
+		if port, err := strconv.Atoi(m.Port); err != nil || port <= 0 || port > 65535 {
+			errs.add("Mail.Port", "invalid port %q", m.Port)
+		}
+	}
+	if m.Host != "" && m.Port == "" {
+		errs.add("Mail.Port", "must be set when Mail.Host is")
+	}
+	return errs
+}
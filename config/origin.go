@@ -0,0 +1,174 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// An origin from a request's Origin header.
+type origin struct {
+	Scheme string
+	Host   string
+	Port   string // Always set, using the scheme's default if not specified
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Parses an Origin header value.
+func parseOrigin(s string) (origin, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return origin{}, err
+	}
+	o := origin{Scheme: strings.ToLower(u.Scheme), Host: strings.ToLower(u.Hostname()), Port: u.Port()}
+	defaultPort, ok := defaultPorts[o.Scheme]
+	if !ok {
+		return origin{}, fmt.Errorf("scheme must be http or https")
+	}
+	if o.Host == "" {
+		return origin{}, fmt.Errorf("no host")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return origin{}, fmt.Errorf("must only contain scheme, host and port")
+	}
+	if o.Port == "" {
+		o.Port = defaultPort
+	}
+	return o, nil
+}
+
+// A compiled AllowedOrigins pattern, of the form scheme://host[:port].
+//
+//   - scheme is http, https or * (either).
+//   - host is matched exactly, except that a leading "*." matches one or more
+//     subdomain labels, and * elsewhere matches within a single label (so
+//     pr-*.preview.example.com matches pr-123.preview.example.com but not
+//     pr-1.x.preview.example.com).
+//   - port, if given, is a number or * (any port). Without it, only the
+//     scheme's default port matches.
+type originPattern struct {
+	Pattern string // As configured
+	scheme  string // "*" for any
+	port    string // "" for the scheme's default, "*" for any
+	host    *regexp.Regexp
+	example string // A host matching the pattern, used to detect overlaps
+}
+
+var validHostPattern = regexp.MustCompile(`^[a-z0-9*._\-:]+$`)
+
+// Parses and compiles an AllowedOrigins pattern.
+func compileOrigin(pattern string) (originPattern, error) {
+	p := originPattern{Pattern: pattern}
+	scheme, rest, found := strings.Cut(strings.ToLower(pattern), "://")
+	if !found {
+		return p, fmt.Errorf("must be of the form scheme://host[:port]")
+	}
+	if _, ok := defaultPorts[scheme]; !ok && scheme != "*" {
+		return p, fmt.Errorf("scheme must be http, https or *")
+	}
+	p.scheme = scheme
+
+	rest = strings.TrimSuffix(rest, "/")
+	if strings.ContainsAny(rest, "/?#@") {
+		return p, fmt.Errorf("must only contain scheme, host and port")
+	}
+	host := rest
+	if h, port, err := net.SplitHostPort(rest); err == nil {
+		host, p.port = h, port
+		if port == "" || (port != "*" && strings.Trim(port, "0123456789") != "") {
+			return p, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" || !validHostPattern.MatchString(host) {
+		return p, fmt.Errorf("invalid host %q", host)
+	}
+
+	var re, example strings.Builder
+	re.WriteString("^")
+	if after, ok := strings.CutPrefix(host, "*."); ok {
+		re.WriteString(`(?:[^.]+\.)+`)
+		example.WriteString("x.")
+		host = after
+	}
+	for i, part := range strings.Split(host, "*") {
+		if i > 0 {
+			re.WriteString(`[^.]*`)
+			example.WriteString("x")
+		}
+		re.WriteString(regexp.QuoteMeta(part))
+		example.WriteString(part)
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return p, err
+	}
+	p.host = compiled
+	p.example = example.String()
+	return p, nil
+}
+
+// Returns true if the origin o is allowed by p.
+func (p originPattern) matches(o origin) bool {
+	if p.scheme != "*" && p.scheme != o.Scheme {
+		return false
+	}
+	switch p.port {
+	case "*":
+	case "":
+		if o.Port != defaultPorts[o.Scheme] {
+			return false
+		}
+	default:
+		if o.Port != p.port {
+			return false
+		}
+	}
+	return p.host.MatchString(o.Host)
+}
+
+// Returns the schemes and ports (as scheme:port) that p allows, with "*"
+// meaning any port.
+func (p originPattern) endpoints() []string {
+	schemes := []string{p.scheme}
+	if p.scheme == "*" {
+		schemes = []string{"http", "https"}
+	}
+	var rv []string
+	for _, s := range schemes {
+		port := p.port
+		if port == "" {
+			port = defaultPorts[s]
+		}
+		rv = append(rv, s+":"+port)
+	}
+	return rv
+}
+
+// Returns true if some origin is likely to match both p and q.
+//
+// Exact overlap of two wildcard patterns is hard to determine, so this checks
+// whether either pattern matches an example host of the other.
+func (p originPattern) overlaps(q originPattern) bool {
+	shared := false
+	for _, a := range p.endpoints() {
+		for _, b := range q.endpoints() {
+			as, ap, _ := strings.Cut(a, ":")
+			bs, bp, _ := strings.Cut(b, ":")
+			if as == bs && (ap == bp || ap == "*" || bp == "*") {
+				shared = true
+			}
+		}
+	}
+	if !shared {
+		return false
+	}
+	return p.host.MatchString(q.example) || q.host.MatchString(p.example)
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults for SpamConfig.
+const (
+	DEFAULT_SPAM_THRESHOLD   = 5
+	DEFAULT_SPAM_MAX_LINKS   = 2
+	DEFAULT_MIN_SUBMIT_DELAY = 3 * time.Second
+	// Proof of work difficulties above this take too long for browsers.
+	MAX_PROOF_OF_WORK_BITS = 24
+)
+
+// Spam defences for a site's contact form. Each check which fails adds to the
+// submission's spam score; those scoring at least Threshold are logged but
+// not emailed.
+//
+// A honeypot field ("website") and the links and BlockedKeywords in the
+// message are always checked. RequireToken and ProofOfWorkBits enable checks
+// which need the form to fetch a token from /contact/token first.
+type SpamConfig struct {
+	// Score at which a submission is spam, defaults to DEFAULT_SPAM_THRESHOLD.
+	Threshold int
+	// Links allowed in a submission before each adds to the score, defaults
+	// to DEFAULT_SPAM_MAX_LINKS. -1 allows none.
+	MaxLinks int
+	// Words or phrases, matched case insensitively, which add to the score.
+	BlockedKeywords []string
+
+	// Require a token issued at least MinSubmitSeconds (defaulting to
+	// DEFAULT_MIN_SUBMIT_DELAY) before the form is submitted.
+	RequireToken     bool
+	MinSubmitSeconds int
+	// Require a proof of work for the token, with this many leading zero
+	// bits. 0 disables.
+	ProofOfWorkBits int
+}
+
+// Returns the configured Threshold, or its default.
+func (s SpamConfig) ThresholdOrDefault() int {
+	if s.Threshold == 0 {
+		return DEFAULT_SPAM_THRESHOLD
+	}
+	return s.Threshold
+}
+
+// Returns the number of links allowed: the configured MaxLinks, or its
+// default.
+func (s SpamConfig) MaxLinksOrDefault() int {
+	switch s.MaxLinks {
+	case 0:
+		return DEFAULT_SPAM_MAX_LINKS
+	case -1:
+		return 0
+	}
+	return s.MaxLinks
+}
+
+// Returns how long after a token is issued a form may be submitted.
+func (s SpamConfig) MinSubmitDelay() time.Duration {
+	if s.MinSubmitSeconds == 0 {
+		return DEFAULT_MIN_SUBMIT_DELAY
+	}
+	return time.Duration(s.MinSubmitSeconds) * time.Second
+}
+
+func (s SpamConfig) validate(path string, errs *ValidationErrors) {
+	if s.Threshold < 0 {
+		errs.add(path+".Threshold", "must not be negative")
+	}
+	if s.MaxLinks < -1 {
+		errs.add(path+".MaxLinks", "must be -1 (for none) or more")
+	}
+	for i, kw := range s.BlockedKeywords {
+		if kw == "" {
+			errs.add(fmt.Sprintf("%s.BlockedKeywords[%d]", path, i), "must not be empty")
+		}
+	}
+	if s.MinSubmitSeconds < 0 {
+		errs.add(path+".MinSubmitSeconds", "must not be negative")
+	}
+	if s.ProofOfWorkBits < 0 || s.ProofOfWorkBits > MAX_PROOF_OF_WORK_BITS {
+		errs.add(path+".ProofOfWorkBits", "must be between 0 and %d", MAX_PROOF_OF_WORK_BITS)
+	} else if s.ProofOfWorkBits > 0 && !s.RequireToken {
+		errs.add(path+".ProofOfWorkBits", "requires RequireToken")
+	}
+}
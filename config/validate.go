@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// A problem with the config, and where it was found.
+type ValidationError struct {
+	Path    string // e.g. Sites[1].AllowedOrigins[0]
+	Problem string
+	Line    int // In the config file, if known
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Problem)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Problem)
+}
+
+// All problems found with a config.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("%d config problem(s):\n  %s", len(e), strings.Join(lines, "\n  "))
+}
+
+func (e *ValidationErrors) add(path string, format string, args ...any) {
+	*e = append(*e, ValidationError{Path: path, Problem: fmt.Sprintf(format, args...)})
+}
+
+// Parses the CIDR networks at path, adding any which don't parse to errs.
+func parseNets(cidrs []string, path string, errs *ValidationErrors) []*net.IPNet {
+	var nets []*net.IPNet
+	for i, cidrNet := range cidrs {
+		_, net, err := net.ParseCIDR(cidrNet)
+		if err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "could not parse ignored network %s: %v", cidrNet, err)
+			continue
+		}
+		nets = append(nets, net)
+	}
+	return nets
+}
+
+// Checks the config for problems, returning ValidationErrors listing all of
+// them, or nil if there are none.
+//
+// Validate also prepares the parsed forms of IgnoreNets and AllowedOrigins used
+// by IsIgnoredIP, IgnoreReason and GetHostForOrigin, so must be called on any config not
+// obtained from LoadConfig.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+
+	c._ignoredNets = parseNets(c.IgnoreNets, "IgnoreNets", &errs)
+
+	hosts := make(map[string]int)
+	type allowed struct {
+		path    string
+		site    int
+		pattern originPattern
+	}
+	var origins []allowed
+	for i := range c.Sites {
+		site := &c.Sites[i]
+		path := fmt.Sprintf("Sites[%d]", i)
+		if site.Host == "" {
+			errs.add(path+".Host", "must be set")
+		} else if prev, ok := hosts[site.Host]; ok {
+			errs.add(path+".Host", "%s is already configured by Sites[%d]", site.Host, prev)
+		} else {
+			hosts[site.Host] = i
+		}
+
+		if len(site.AllowedOrigins) == 0 {
+			errs.add(path+".AllowedOrigins", "at least one origin is required")
+		}
+		site._origins = nil
+		for j, s := range site.AllowedOrigins {
+			opath := fmt.Sprintf("%s.AllowedOrigins[%d]", path, j)
+			p, err := compileOrigin(s)
+			if err != nil {
+				errs.add(opath, "invalid origin %q: %v", s, err)
+				continue
+			}
+			for _, other := range origins {
+				if other.site != i && other.pattern.overlaps(p) {
+					errs.add(opath, "%s overlaps %s", s, other.path)
+				}
+			}
+			origins = append(origins, allowed{opath, i, p})
+			site._origins = append(site._origins, p)
+		}
+
+		for j, contact := range site.Contacts {
+			if _, err := mail.ParseAddress(contact); err != nil {
+				errs.add(fmt.Sprintf("%s.Contacts[%d]", path, j), "invalid address %q: %v", contact, err)
+			}
+		}
+
+		validateContactForm(path+".ContactForm", site.ContactForm, &errs)
+		site.ContactMail.validate(path+".ContactMail", &errs)
+
+		if err := site.IPMode.validate(); err != nil {
+			errs.add(path+".IPMode", "%v", err)
+		}
+		if site.IPMode == IP_HASH && c.IPHashSecret == "" {
+			errs.add(path+".IPMode", "hash requires IPHashSecret to be set")
+		}
+		if err := site.PrivacySignals.validate(); err != nil {
+			errs.add(path+".PrivacySignals", "%v", err)
+		}
+
+		site._ignoredNets = parseNets(site.IgnoreNets, path+".IgnoreNets", &errs)
+		site._ignorePaths = nil
+		for j, pattern := range site.IgnorePaths {
+			if !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "*") {
+				errs.add(fmt.Sprintf("%s.IgnorePaths[%d]", path, j), "pattern %q must start with / or *", pattern)
+				continue
+			}
+			site._ignorePaths = append(site._ignorePaths, compileGlob(pattern, false))
+		}
+		site._ignoreUserAgents = nil
+		for j, pattern := range site.IgnoreUserAgents {
+			if pattern == "" {
+				errs.add(fmt.Sprintf("%s.IgnoreUserAgents[%d]", path, j), "pattern must not be empty")
+				continue
+			}
+			site._ignoreUserAgents = append(site._ignoreUserAgents, compileGlob(pattern, true))
+		}
+		site.Spam.validate(path+".Spam", &errs)
+	}
+
+	if c.SpoolMaxBytes < 0 {
+		errs.add("SpoolMaxBytes", "must not be negative")
+	}
+	c.Admin.validate(&errs)
+	c.validateAccess(&errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
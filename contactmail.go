@@ -0,0 +1,214 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/email"
+	"mattb.nz/web/metrics/templates"
+)
+
+// Returns the text/template at path, or if path is empty, the named embedded
+// template.
+func loadTextTemplate(path, builtin string) (*template.Template, error) {
+	if path != "" {
+		return template.New(filepath.Base(path)).ParseFiles(path)
+	}
+	return templates.Get(builtin)
+}
+
+// Returns the html/template at path, or if path is empty, the named embedded
+// template.
+func loadHTMLTemplate(path, builtin string) (*htmltemplate.Template, error) {
+	if path != "" {
+		return htmltemplate.New(filepath.Base(path)).ParseFiles(path)
+	}
+	return templates.GetHTML(builtin)
+}
+
+// The templates an email is rendered from.
+type mailTemplates struct {
+	Subject      string // text/template
+	TextTemplate string // Path, or "" for the builtin
+	HTMLTemplate string // Path, or "" for the builtin
+	// Names of the embedded templates used by default.
+	TextBuiltin string
+	HTMLBuiltin string
+}
+
+// Renders msg's subject and bodies from tmpls with the data available to
+// contact mail templates, returning it ready to be queued.
+func renderMail(msg email.Message, tmpls mailTemplates, event db.MailLog) (db.QueuedMail, error) {
+	data := map[string]any{
+		"From":  msg.From.Address,
+		"To":    msg.Recipients(),
+		"Event": event,
+	}
+
+	var buf bytes.Buffer
+	subject, err := template.New("subject").Parse(tmpls.Subject)
+	if err != nil {
+		return db.QueuedMail{}, err
+	}
+	if err := subject.Execute(&buf, data); err != nil {
+		return db.QueuedMail{}, err
+	}
+	// Newlines (e.g. from the submitter's name) would end the header.
+	msg.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	text, err := loadTextTemplate(tmpls.TextTemplate, tmpls.TextBuiltin)
+	if err != nil {
+		return db.QueuedMail{}, err
+	}
+	buf.Reset()
+	if err := text.Execute(&buf, data); err != nil {
+		return db.QueuedMail{}, err
+	}
+	msg.Text = buf.String()
+
+	html, err := loadHTMLTemplate(tmpls.HTMLTemplate, tmpls.HTMLBuiltin)
+	if err != nil {
+		return db.QueuedMail{}, err
+	}
+	buf.Reset()
+	if err := html.Execute(&buf, data); err != nil {
+		return db.QueuedMail{}, err
+	}
+	msg.HTML = buf.String()
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return db.QueuedMail{}, err
+	}
+	return db.QueuedMail{
+		MailLogID: event.ID,
+		Host:      event.Host,
+		From:      msg.From.Address,
+		To:        strings.Join(msg.Recipients(), ","),
+		Body:      body,
+	}, nil
+}
+
+// Returns the submitter's address, if they gave one in the form's first
+// email field or the contact details.
+func submitterAddress(event db.MailLog) *mail.Address {
+	given := event.Details
+	for _, f := range event.Fields {
+		if f.Type == config.FIELD_EMAIL {
+			given = f.Value
+			break
+		}
+	}
+	addr, err := mail.ParseAddress(strings.TrimSpace(given))
+	if err != nil {
+		return nil
+	}
+	if addr.Name == "" {
+		addr.Name = event.Name
+	}
+	return addr
+}
+
+// Renders the email sending event (a contact form submission) to the site's
+// Contacts, ready to be queued.
+func renderContactMail(site config.MonitoredSite, event db.MailLog) (db.QueuedMail, error) {
+	msg := email.Message{From: *site.ContactMail.FromAddress(), Date: event.When}
+	for _, contact := range site.Contacts {
+		if addr, err := mail.ParseAddress(contact); err == nil {
+			msg.To = append(msg.To, *addr)
+		}
+	}
+	// Replies go to the submitter, if they gave an email address.
+	msg.ReplyTo = submitterAddress(event)
+	return renderMail(msg, mailTemplates{
+		Subject:      site.ContactMail.SubjectTemplate(),
+		TextTemplate: site.ContactMail.TextTemplate,
+		HTMLTemplate: site.ContactMail.HTMLTemplate,
+		TextBuiltin:  "contactform.tmpl",
+		HTMLBuiltin:  "contactform.html",
+	}, event)
+}
+
+// Held while checking the auto-reply rate limits and queueing a reply, so
+// concurrent submissions can't all be within the limits.
+var autoReplyMu sync.Mutex
+
+// Queues an acknowledgement of event (a contact form submission) to the
+// submitter, if the site sends them and they gave an email address which
+// hasn't been sent one recently, within the site's limits on replies. Returns
+// what was done, to be logged.
+func queueAutoReply(site config.MonitoredSite, event db.MailLog, now time.Time) (db.AutoReplyStatus, error) {
+	conf := site.ContactMail.AutoReply
+	if !conf.Enabled {
+		return db.AUTOREPLY_NONE, nil
+	}
+	to := submitterAddress(event)
+	if to == nil {
+		return db.AUTOREPLY_NONE, nil
+	}
+	if db.Current() == nil {
+		return db.AUTOREPLY_FAILED, errors.New("no database available to rate limit replies")
+	}
+	// The name is the submitter's choice, so isn't included.
+	to.Name = ""
+	to.Address = strings.ToLower(to.Address)
+
+	// Limit replies to each address, from each IP and for the site, so the
+	// form can't be used to send mail to anyone.
+	autoReplyMu.Lock()
+	defer autoReplyMu.Unlock()
+	since := now.Add(-conf.RateLimit())
+	n, err := db.Count(&db.QueuedMail{}, "kind = ? AND `to` = ? AND created > ?", db.MAIL_AUTOREPLY, to.Address, since)
+	if err != nil {
+		return db.AUTOREPLY_FAILED, err
+	}
+	if n > 0 {
+		return db.AUTOREPLY_RATE_LIMITED, nil
+	}
+	if event.IP != "" {
+		n, err := db.CountAutoReplies(event.Host, event.IP, since)
+		if err != nil {
+			return db.AUTOREPLY_FAILED, err
+		}
+		if n >= int64(conf.MaxPerIPOrDefault()) {
+			return db.AUTOREPLY_RATE_LIMITED, nil
+		}
+	}
+	n, err = db.CountAutoReplies(event.Host, "", now.Add(-time.Hour))
+	if err != nil {
+		return db.AUTOREPLY_FAILED, err
+	}
+	if n >= int64(conf.MaxPerHourOrDefault()) {
+		return db.AUTOREPLY_RATE_LIMITED, nil
+	}
+
+	reply, err := renderMail(email.Message{
+		From: *site.ContactMail.FromAddress(),
+		To:   []mail.Address{*to},
+		Date: now,
+	}, mailTemplates{
+		Subject:      conf.SubjectTemplate(),
+		TextTemplate: conf.TextTemplate,
+		HTMLTemplate: conf.HTMLTemplate,
+		TextBuiltin:  "autoreply.tmpl",
+		HTMLBuiltin:  "autoreply.html",
+	}, event)
+	if err != nil {
+		return db.AUTOREPLY_FAILED, err
+	}
+	reply.Kind = db.MAIL_AUTOREPLY
+	if err := queueMail(reply); err != nil {
+		return db.AUTOREPLY_FAILED, err
+	}
+	return db.AUTOREPLY_QUEUED, nil
+}
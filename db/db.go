@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/driver/sqlite"
@@ -13,7 +14,9 @@ import (
 	"mattb.nz/web/metrics/config"
 )
 
-var DB *gorm.DB
+// The database in use, or nil if it isn't available. It's opened in the
+// background while handlers are using it, so is published atomically.
+var current atomic.Pointer[gorm.DB]
 var models []interface{}
 
 type PreCheckModel interface {
@@ -39,13 +42,39 @@ func Init(config config.Config) error {
 	if err := db.AutoMigrate(&Meta{}); err != nil {
 		return fmt.Errorf("could not automigrate metadata table: %w", err)
 	}
-	DB = db // Set before migrations so callbacks can access metadata
+	current.Store(db) // Set before migrations so callbacks can access metadata
 	if err := automigrate(db); err != nil {
 		return fmt.Errorf("could not automigrate: %w", err)
 	}
 	return nil
 }
 
+// Closes the database. The wrappers below then no-op as if it was never
+// available.
+func Close() error {
+	db := current.Swap(nil)
+	if db == nil {
+		return nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Returns the database, or nil if it isn't available. Callers should use the
+// returned value throughout, rather than calling again, in case the database
+// is closed in between.
+func Current() *gorm.DB {
+	return current.Load()
+}
+
+// Replaces the database in use, with nil making it unavailable.
+func Set(conn *gorm.DB) {
+	current.Store(conn)
+}
+
 func register(model interface{}) {
 	models = append(models, model)
 }
@@ -72,31 +101,45 @@ func automigrate(db *gorm.DB) error {
 
 // Wrappers for gorm.DB methods to no-op if DB is not available
 func Create(value interface{}) *gorm.DB {
-	if DB == nil {
+	conn := Current()
+	if conn == nil {
 		return &gorm.DB{}
 	}
-	return DB.Create(value)
+	return conn.Create(value)
 }
 
 func Find(out interface{}, where ...interface{}) *gorm.DB {
-	if DB == nil {
+	conn := Current()
+	if conn == nil {
 		return &gorm.DB{}
 	}
-	return DB.Find(out, where...)
+	return conn.Find(out, where...)
 }
 
 func First(out interface{}, where ...interface{}) *gorm.DB {
-	if DB == nil {
+	conn := Current()
+	if conn == nil {
 		return &gorm.DB{}
 	}
-	return DB.First(out, where...)
+	return conn.First(out, where...)
 }
 
 func Count(table interface{}, query any, args ...any) (int64, error) {
-	if DB == nil {
+	conn := Current()
+	if conn == nil {
+		return 0, nil
+	}
+	var count int64
+	err := conn.Model(table).Where(query, args...).Count(&count).Error
+	return count, err
+}
+
+func CountDistinct(table interface{}, column string, query any, args ...any) (int64, error) {
+	conn := Current()
+	if conn == nil {
 		return 0, nil
 	}
 	var count int64
-	err := DB.Model(table).Where(query, args...).Count(&count).Error
+	err := conn.Model(table).Distinct(column).Where(query, args...).Count(&count).Error
 	return count, err
 }
@@ -41,9 +41,31 @@ func Test_DB(t *testing.T) {
 	}
 }
 
+// Check events stored before session_id was added have it filled in.
+func Test_SessionMigration(t *testing.T) {
+	Init(config.Config{
+		DatabaseUrl: "file::memory:?cache=shared",
+	})
+
+	event := EventLog{Host: "migrate.com", RawEvent: metrics.JsonEvent{Event: metrics.EV_PAGEVIEW, SessionId: "old"}}
+	if err := Create(&event).Error; err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if err := Current().Where("key = ?", "EL_SESSION_ID_DONE").Delete(&Meta{}).Error; err != nil {
+		t.Fatal("Could not reset migration:", err)
+	}
+	if err := (&EventLog{}).PostMigrate(Current()); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	back := EventLog{}
+	if err := First(&back, event.ID).Error; err != nil || back.SessionID != "old" {
+		t.Errorf("Expected session to be migrated, got %q, %v", back.SessionID, err)
+	}
+}
+
 // Check the no-op methods don't cause issues when we have no DB.
 func Test_NoDB(t *testing.T) {
-	DB = nil
+	Set(nil)
 
 	if err := Create(&EventLog{}).Error; err != nil {
 		t.Error("Expected no error, got", err)
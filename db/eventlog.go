@@ -1,12 +1,14 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"gorm.io/gorm"
 	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/useragent"
 )
 
 var ua_cache = make(map[string]uint)
@@ -14,16 +16,74 @@ var ua_cache = make(map[string]uint)
 type UserAgent struct {
 	ID        uint `gorm:"primarykey"`
 	UserAgent string
+	// Parsed from UserAgent
+	Browser        string
+	BrowserVersion string
+	OS             string
+	Device         useragent.DeviceClass
+}
+
+// Sets the parsed fields from the raw UserAgent string.
+func (u *UserAgent) parse() {
+	info := useragent.Parse(u.UserAgent)
+	u.Browser = info.Browser
+	u.BrowserVersion = info.BrowserVersion
+	u.OS = info.OS
+	u.Device = info.Device
+}
+
+// Re-parses every stored UserAgent, returning the number updated.
+func BackfillUserAgents() (int, error) {
+	conn := Current()
+	var uas []UserAgent
+	if err := conn.Find(&uas).Error; err != nil {
+		return 0, fmt.Errorf("could not list user agents: %w", err)
+	}
+	n := 0
+	for _, ua := range uas {
+		old := ua
+		ua.parse()
+		if ua == old {
+			continue
+		}
+		if err := conn.Save(&ua).Error; err != nil {
+			return n, fmt.Errorf("could not update user agent %d: %w", ua.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (u *UserAgent) PostMigrate(db *gorm.DB) error {
+	done, err := GetMetadata("UA_PARSED_DONE")
+	if err != nil {
+		return fmt.Errorf("failed to check UserAgent parsing status: %w", err)
+	}
+	if done == "completed" {
+		return nil
+	}
+	log.Printf("Parsing existing UserAgents...")
+	n, err := BackfillUserAgents()
+	if err != nil {
+		return fmt.Errorf("failed to parse UserAgents: %w", err)
+	}
+	if err := SetMetadata("UA_PARSED_DONE", "completed"); err != nil {
+		return fmt.Errorf("UserAgent parsing completed, but status not set: %w", err)
+	}
+	log.Printf("Parsing of %d existing UserAgents completed.", n)
+	return nil
 }
 
 func GetUserAgentID(userAgent string) uint {
+	conn := Current()
 	if id, ok := ua_cache[userAgent]; ok {
 		return id
 	}
 	ua := UserAgent{}
-	if err := DB.Where("user_agent = ?", userAgent).First(&ua).Error; err != nil {
+	if err := conn.Where("user_agent = ?", userAgent).First(&ua).Error; err != nil {
 		ua.UserAgent = userAgent
-		if err := DB.Create(&ua).Error; err != nil {
+		ua.parse()
+		if err := conn.Create(&ua).Error; err != nil {
 			log.Printf("Could not create user agent: %v", err)
 			return 0
 		}
@@ -40,7 +100,49 @@ type EventLog struct {
 	Referer     string // Who sent the user to the above page.
 	UserAgentID uint
 	IP          string
+	VisitorID   string // Anonymous daily visitor ID, see VisitorID().
+	Country     string // ISO country code, from GeoIP lookup of IP.
+	Region      string
+	City        string
 	RawEvent    metrics.JsonEvent `gorm:"serializer:json"`
+	// Copied from RawEvent, so events can be joined by session.
+	SessionID string `gorm:"index"`
+	// Campaign (utm_*) parameters extracted from Page.
+	UtmSource   string
+	UtmMedium   string
+	UtmCampaign string
+	UtmTerm     string
+	UtmContent  string
+}
+
+// An event to be stored, with the User-Agent header in place of UserAgentID
+// which can only be looked up once the database is available.
+type PendingEvent struct {
+	EventLog
+	UserAgent string `json:",omitempty"`
+}
+
+// Stores e, looking up (or creating) the ID of its User-Agent.
+func StoreEvent(e PendingEvent) error {
+	conn := Current()
+	if conn == nil {
+		return errors.New("database not available")
+	}
+	logEvent := e.EventLog
+	logEvent.SessionID = logEvent.RawEvent.SessionId
+	if e.UserAgent != "" {
+		logEvent.UserAgentID = GetUserAgentID(e.UserAgent)
+	}
+	return conn.Create(&logEvent).Error
+}
+
+// Sets the utm_* columns from the provided campaign.
+func (e *EventLog) SetCampaign(c metrics.Campaign) {
+	e.UtmSource = c.Source
+	e.UtmMedium = c.Medium
+	e.UtmCampaign = c.Name
+	e.UtmTerm = c.Term
+	e.UtmContent = c.Content
 }
 
 func (e *EventLog) PostMigrate(db *gorm.DB) error {
@@ -48,18 +150,34 @@ func (e *EventLog) PostMigrate(db *gorm.DB) error {
 	if err != nil {
 		return fmt.Errorf("failed to check EventLog referer migration status: %w", err)
 	}
+	if done != "completed" {
+		// Need to migrate current contents of 'referer' into 'page'
+		log.Printf("Migrating EventLog.referer to EventLog.page...")
+		if err := db.Exec("UPDATE event_logs SET page=referer, referer=''").Error; err != nil {
+			return fmt.Errorf("failed to migrate EventLog referer: %w", err)
+		}
+		if err := SetMetadata("EL_REFERER_TO_PAGE_DONE", "completed"); err != nil {
+			return fmt.Errorf("EventLog referer migration completed, but status not set: %w", err)
+		}
+		log.Printf("Migration of EventLog.referer to EventLog.page completed.")
+	}
+
+	done, err = GetMetadata("EL_SESSION_ID_DONE")
+	if err != nil {
+		return fmt.Errorf("failed to check EventLog session migration status: %w", err)
+	}
 	if done == "completed" {
 		return nil
 	}
-	// Need to migrate current contents of 'referer' into 'page'
-	log.Printf("Migrating EventLog.referer to EventLog.page...")
-	if err := db.Exec("UPDATE event_logs SET page=referer, referer=''").Error; err != nil {
-		return fmt.Errorf("failed to migrate EventLog referer: %w", err)
+	// Copy the session of events stored before it had its own column.
+	log.Printf("Migrating EventLog.raw_event SessionId to EventLog.session_id...")
+	if err := db.Exec("UPDATE event_logs SET session_id=json_extract(raw_event, '$.SessionId') WHERE (session_id IS NULL OR session_id='') AND json_extract(raw_event, '$.SessionId') != ''").Error; err != nil {
+		return fmt.Errorf("failed to migrate EventLog session: %w", err)
 	}
-	if err := SetMetadata("EL_REFERER_TO_PAGE_DONE", "completed"); err != nil {
-		return fmt.Errorf("EventLog referer migration completed, but status not set: %w", err)
+	if err := SetMetadata("EL_SESSION_ID_DONE", "completed"); err != nil {
+		return fmt.Errorf("EventLog session migration completed, but status not set: %w", err)
 	}
-	log.Printf("Migration of EventLog.referer to EventLog.page completed.")
+	log.Printf("Migration of EventLog session_id completed.")
 	return nil
 }
 
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/useragent"
 )
 
 func Test_GetUsrAgentID(t *testing.T) {
@@ -28,10 +29,30 @@ func Test_GetUsrAgentID(t *testing.T) {
 	}
 
 	var c int64
-	if err := DB.Model(&UserAgent{}).Count(&c).Error; err != nil {
+	if err := Current().Model(&UserAgent{}).Count(&c).Error; err != nil {
 		t.Error("Error counting user agents:", err)
 	}
 	if c != 2 {
 		t.Error("Expected 2 user agents, got", c)
 	}
+
+	id = GetUserAgentID("Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0")
+	ua := UserAgent{}
+	if err := Current().First(&ua, id).Error; err != nil {
+		t.Fatal("Error finding user agent:", err)
+	}
+	if ua.Browser != "Firefox" || ua.BrowserVersion != "121" || ua.OS != "Linux" || ua.Device != useragent.DEVICE_DESKTOP {
+		t.Errorf("Expected parsed user agent, got %+v", ua)
+	}
+
+	// Backfill should parse rows created before parsing existed.
+	if err := Current().Model(&ua).Updates(map[string]any{"browser": "", "os": ""}).Error; err != nil {
+		t.Fatal("Error clearing user agent:", err)
+	}
+	if n, err := BackfillUserAgents(); err != nil || n != 1 {
+		t.Errorf("Expected 1 user agent backfilled, got %d (err %v)", n, err)
+	}
+	if err := Current().First(&ua, id).Error; err != nil || ua.Browser != "Firefox" || ua.OS != "Linux" {
+		t.Errorf("Expected backfilled user agent, got %+v (err %v)", ua, err)
+	}
 }
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+var errRollback = errors.New("rollback")
+
+// Checks the database is reachable and writable, by writing a metadata row in
+// a transaction which is then rolled back.
+func Check(ctx context.Context) error {
+	conn := Current()
+	if conn == nil {
+		return errors.New("database not available")
+	}
+	err := conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&Meta{Key: "health_check"}).Error; err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Rewrites the IP column of the rows in table belonging to host using
+// anonymise, returning the number of rows changed.
+func ReanonymiseIPs(table interface{}, host string, anonymise func(string) string) (int64, error) {
+	conn := Current()
+	if conn == nil {
+		return 0, errors.New("no database available")
+	}
+	var ips []string
+	if err := conn.Model(table).Where("host = ?", host).Distinct().Pluck("ip", &ips).Error; err != nil {
+		return 0, fmt.Errorf("could not list IPs: %w", err)
+	}
+	var changed int64
+	for _, ip := range ips {
+		anon := anonymise(ip)
+		if anon == ip {
+			continue
+		}
+		rv := conn.Model(table).Where("host = ? AND ip = ?", host, ip).Update("ip", anon)
+		if rv.Error != nil {
+			return changed, fmt.Errorf("could not update %s: %w", ip, rv.Error)
+		}
+		changed += rv.RowsAffected
+	}
+	return changed, nil
+}
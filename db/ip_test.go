@@ -0,0 +1,42 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"mattb.nz/web/metrics/config"
+)
+
+func Test_ReanonymiseIPs(t *testing.T) {
+	Init(config.Config{
+		DatabaseUrl: "file::memory:?cache=shared",
+	})
+
+	for _, e := range []EventLog{
+		{Host: "anon.com", IP: "10.10.10.10"},
+		{Host: "anon.com", IP: "10.10.10.10"},
+		{Host: "anon.com", IP: "10.10.10.0"},
+		{Host: "other.com", IP: "10.10.10.10"},
+	} {
+		if err := Create(&e).Error; err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+
+	truncate := func(ip string) string {
+		return ip[:strings.LastIndex(ip, ".")] + ".0"
+	}
+	n, err := ReanonymiseIPs(&EventLog{}, "anon.com", truncate)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if n != 2 {
+		t.Error("Expected 2 rows changed, got", n)
+	}
+	if c, _ := Count(&EventLog{}, "host = ? AND ip = ?", "anon.com", "10.10.10.0"); c != 3 {
+		t.Error("Expected 3 truncated rows, got", c)
+	}
+	if c, _ := Count(&EventLog{}, "host = ? AND ip = ?", "other.com", "10.10.10.10"); c != 1 {
+		t.Error("Expected other.com row to be untouched, got", c)
+	}
+}
@@ -1,20 +1,62 @@
 package db
 
 import (
+	"strings"
 	"time"
+
+	"mattb.nz/web/metrics/config"
 )
 
 type MailLog struct {
-	ID      uint `gorm:"primarykey"`
-	When    time.Time
-	Host    string
+	ID   uint `gorm:"primarykey"`
+	When time.Time
+	Host string
+	// The fields of the site's contact form, as submitted.
+	Fields FormValues `gorm:"serializer:json"`
+	// Copies of the Fields of the same names, if the form has them (as the
+	// default does), for templates and searches.
 	Name    string
 	Org     string
 	Details string
 	Msg     string
 	IP      string
+	// How likely the submission is to be spam, and why, see spam.Check.
+	SpamScore   int
+	SpamReasons string
+	// Whether the submitter was sent an acknowledgement.
+	AutoReply AutoReplyStatus
+}
+
+// A submitted contact form field, see config.FormField.
+type FormValue struct {
+	Name  string
+	Label string
+	Type  config.FieldType
+	Value string
 }
 
+type FormValues []FormValue
+
+// Returns the value of the field named name (matched case insensitively, as
+// for config.FormField), or "" if there isn't one.
+func (f FormValues) Get(name string) string {
+	for _, v := range f {
+		if strings.EqualFold(v.Name, name) {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+type AutoReplyStatus string
+
+const (
+	AUTOREPLY_NONE         AutoReplyStatus = ""             // Not enabled, or no email address given.
+	AUTOREPLY_QUEUED       AutoReplyStatus = "queued"       // See the QueuedMail with Kind MAIL_AUTOREPLY.
+	AUTOREPLY_RATE_LIMITED AutoReplyStatus = "rate_limited" // The address, IP or site was sent too many recently.
+	AUTOREPLY_FAILED       AutoReplyStatus = "failed"
+)
+
 func init() {
 	register(&MailLog{})
 }
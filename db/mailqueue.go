@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type MailStatus string
+
+const (
+	MAIL_PENDING MailStatus = "pending" // Waiting to be sent, or retried.
+	MAIL_SENT    MailStatus = "sent"
+	MAIL_DEAD    MailStatus = "dead" // Gave up after too many attempts.
+)
+
+type MailKind string
+
+const (
+	MAIL_CONTACT   MailKind = ""          // A contact form submission, to the site's Contacts.
+	MAIL_AUTOREPLY MailKind = "autoreply" // An acknowledgement to the submitter.
+)
+
+// An outbound email, rendered and ready to send.
+type QueuedMail struct {
+	ID          uint `gorm:"primarykey"`
+	Created     time.Time
+	MailLogID   uint `gorm:"index"` // The contact form submission it's for.
+	Kind        MailKind
+	Host        string
+	From        string
+	To          string // Comma separated.
+	Body        []byte
+	Status      MailStatus `gorm:"index"`
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	Sent        time.Time
+}
+
+func (m QueuedMail) Recipients() []string {
+	return strings.Split(m.To, ",")
+}
+
+// Adds m to the queue, to be sent as soon as possible.
+func QueueMail(m *QueuedMail) error {
+	conn := Current()
+	if conn == nil {
+		return errors.New("no database available")
+	}
+	m.Created = time.Now()
+	m.Status = MAIL_PENDING
+	m.NextAttempt = m.Created
+	return conn.Create(m).Error
+}
+
+// Returns up to limit pending mail due to be sent at now, oldest first.
+func DueMail(now time.Time, limit int) ([]QueuedMail, error) {
+	conn := Current()
+	var rv []QueuedMail
+	if conn == nil {
+		return rv, nil
+	}
+	err := conn.Where("status = ? AND next_attempt <= ?", MAIL_PENDING, now).Order("next_attempt, id").Limit(limit).Find(&rv).Error
+	return rv, err
+}
+
+// Records m was sent, discarding its Body: sent mail can't be resent, and the
+// body holds the submitter's personal data.
+func MailSent(m *QueuedMail) error {
+	conn := Current()
+	m.Attempts++
+	m.Status = MAIL_SENT
+	m.Sent = time.Now()
+	m.LastError = ""
+	m.Body = nil
+	return conn.Save(m).Error
+}
+
+// Records sending m failed with err, to be retried at next, or if next is
+// zero, never.
+func MailFailed(m *QueuedMail, err error, next time.Time) error {
+	conn := Current()
+	m.Attempts++
+	m.LastError = err.Error()
+	m.NextAttempt = next
+	if next.IsZero() {
+		m.Status = MAIL_DEAD
+	}
+	return conn.Save(m).Error
+}
+
+// Returns the mail for host which couldn't be delivered, newest first.
+func DeadMail(host string) ([]QueuedMail, error) {
+	conn := Current()
+	var rv []QueuedMail
+	if conn == nil {
+		return rv, nil
+	}
+	err := conn.Where("status = ? AND host = ?", MAIL_DEAD, host).Order("created DESC").Find(&rv).Error
+	return rv, err
+}
+
+// Returns the number of queued mail with each status.
+func CountMail() (map[MailStatus]int64, error) {
+	conn := Current()
+	rv := make(map[MailStatus]int64)
+	if conn == nil {
+		return rv, nil
+	}
+	var rows []struct {
+		Status MailStatus
+		Count  int64
+	}
+	if err := conn.Model(&QueuedMail{}).Select("status, COUNT(*) AS count").Group("status").Scan(&rows).Error; err != nil {
+		return rv, err
+	}
+	for _, r := range rows {
+		rv[r.Status] = r.Count
+	}
+	return rv, nil
+}
+
+// Returns the number of auto-replies queued for host since since, only
+// counting those acknowledging submissions from ip unless it is "".
+func CountAutoReplies(host, ip string, since time.Time) (int64, error) {
+	conn := Current()
+	if conn == nil {
+		return 0, errors.New("no database available")
+	}
+	q := conn.Model(&QueuedMail{}).Where("queued_mails.kind = ? AND queued_mails.host = ? AND queued_mails.created > ?", MAIL_AUTOREPLY, host, since)
+	if ip != "" {
+		q = q.Joins("JOIN mail_logs ON mail_logs.id = queued_mails.mail_log_id").Where("mail_logs.ip = ?", ip)
+	}
+	var count int64
+	err := q.Count(&count).Error
+	return count, err
+}
+
+// Returns when the oldest pending mail was queued, or the zero time if none
+// is pending.
+func OldestPendingMail() (time.Time, error) {
+	conn := Current()
+	if conn == nil {
+		return time.Time{}, nil
+	}
+	var rv []QueuedMail
+	err := conn.Where("status = ?", MAIL_PENDING).Order("created").Limit(1).Find(&rv).Error
+	if err != nil || len(rv) == 0 {
+		return time.Time{}, err
+	}
+	return rv[0].Created, nil
+}
+
+// Queues mail id (for host) which couldn't be delivered to be sent again,
+// with a fresh set of attempts.
+func ResendMail(id uint, host string) error {
+	conn := Current()
+	if conn == nil {
+		return errors.New("no database available")
+	}
+	res := conn.Model(&QueuedMail{}).Where("id = ? AND host = ? AND status = ?", id, host, MAIL_DEAD).Updates(map[string]any{
+		"status":       MAIL_PENDING,
+		"attempts":     0,
+		"next_attempt": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func init() {
+	register(&QueuedMail{})
+}
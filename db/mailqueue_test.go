@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+)
+
+func Test_MailQueue(t *testing.T) {
+	Init(config.Config{
+		DatabaseUrl: "file::memory:?cache=shared",
+	})
+
+	var queued []*QueuedMail
+	for _, to := range []string{"a@queue.com", "b@queue.com,c@queue.com"} {
+		m := &QueuedMail{Host: "queue.com", From: "me@queue.com", To: to, Body: []byte("hi")}
+		if err := QueueMail(m); err != nil {
+			t.Fatal("Could not queue mail:", err)
+		}
+		queued = append(queued, m)
+	}
+	if r := queued[1].Recipients(); len(r) != 2 || r[1] != "c@queue.com" {
+		t.Errorf("Expected 2 recipients, got %v", r)
+	}
+
+	due, err := DueMail(time.Now(), 10)
+	if err != nil || len(due) < 2 {
+		t.Fatalf("Expected 2 mail due, got %d, %v", len(due), err)
+	}
+	if err := MailSent(queued[0]); err != nil {
+		t.Fatal("Could not mark mail sent:", err)
+	}
+	if sent := (QueuedMail{}); First(&sent, queued[0].ID).Error != nil || sent.Status != MAIL_SENT || len(sent.Body) != 0 {
+		t.Errorf("Expected sent mail to be kept without its body, got %+v", sent)
+	}
+	// Retried later, then given up on.
+	if err := MailFailed(queued[1], errors.New("refused"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("Could not mark mail failed:", err)
+	}
+	due, _ = DueMail(time.Now(), 10)
+	for _, m := range due {
+		if m.Host == "queue.com" {
+			t.Errorf("Expected no mail due, got %+v", m)
+		}
+	}
+	if due, _ := DueMail(time.Now().Add(2*time.Hour), 10); len(due) == 0 || due[len(due)-1].ID != queued[1].ID {
+		t.Errorf("Expected retry to be due later, got %+v", due)
+	}
+	if err := MailFailed(queued[1], errors.New("refused again"), time.Time{}); err != nil {
+		t.Fatal("Could not mark mail failed:", err)
+	}
+	dead, err := DeadMail("queue.com")
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 2 || dead[0].LastError != "refused again" {
+		t.Fatalf("Expected 1 dead mail after 2 attempts, got %+v, %v", dead, err)
+	}
+	if counts, err := CountMail(); err != nil || counts[MAIL_DEAD] < 1 || counts[MAIL_SENT] < 1 {
+		t.Errorf("Expected sent and dead mail to be counted, got %v, %v", counts, err)
+	}
+
+	// Only dead mail for the right host can be resent.
+	if err := ResendMail(queued[0].ID, "queue.com"); err == nil {
+		t.Error("Expected error resending sent mail")
+	}
+	if err := ResendMail(queued[1].ID, "other.com"); err == nil {
+		t.Error("Expected error resending mail for another host")
+	}
+	if err := ResendMail(queued[1].ID, "queue.com"); err != nil {
+		t.Fatal("Could not resend mail:", err)
+	}
+	m := QueuedMail{}
+	if err := First(&m, queued[1].ID).Error; err != nil || m.Status != MAIL_PENDING || m.Attempts != 0 {
+		t.Errorf("Expected mail to be pending again, got %+v, %v", m, err)
+	}
+}
@@ -13,8 +13,9 @@ type Meta struct {
 }
 
 func GetMetadata(key string) (string, error) {
+	conn := Current()
 	m := Meta{}
-	if err := DB.Where("key = ?", key).First(&m).Error; err != nil {
+	if err := conn.Where("key = ?", key).First(&m).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return "", nil
 		}
@@ -24,8 +25,9 @@ func GetMetadata(key string) (string, error) {
 }
 
 func SetMetadata(key, value string) error {
+	conn := Current()
 	m := Meta{Key: key, Value: value}
-	if err := DB.Create(&m).Error; err != nil {
+	if err := conn.Create(&m).Error; err != nil {
 		return err
 	}
 	return nil
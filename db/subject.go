@@ -0,0 +1,274 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"mattb.nz/web/metrics/config"
+)
+
+// Replacement for free text fields when a MailLog is redacted.
+const Redacted = "[redacted]"
+
+// Criteria identifying the data held about a person (data subject).
+//
+// Rows matching any of the criteria are included.
+type SubjectQuery struct {
+	Email     string   // Matched against the address in MailLog.Details or an email field
+	Name      string   // Matched against MailLog.Name, case insensitively
+	IPs       []string // Matched against MailLog.IP and EventLog.IP
+	SessionID string   // Matched against the SessionId of events
+}
+
+func (q SubjectQuery) IsEmpty() bool {
+	return q.Email == "" && q.Name == "" && len(q.IPs) == 0 && q.SessionID == ""
+}
+
+// Returns the names of the criteria set, without their values.
+func (q SubjectQuery) criteria() string {
+	var c []string
+	if q.Email != "" {
+		c = append(c, "email")
+	}
+	if q.Name != "" {
+		c = append(c, "name")
+	}
+	if len(q.IPs) > 0 {
+		c = append(c, "ip")
+	}
+	if q.SessionID != "" {
+		c = append(c, "session")
+	}
+	return strings.Join(c, ",")
+}
+
+// Builds an OR of the provided conditions, or nil if there are none.
+func orWhere(db *gorm.DB, conds []string, args []any) *gorm.DB {
+	if len(conds) == 0 {
+		return nil
+	}
+	return db.Where(strings.Join(conds, " OR "), args...)
+}
+
+// Returns the address in s, lowercased, or "" if s isn't an address.
+func normaliseAddress(s string) string {
+	addr, err := mail.ParseAddress(strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(addr.Address)
+}
+
+// Returns true if m was submitted with address (normalised), as its contact
+// details or in an email field.
+func (m MailLog) hasAddress(address string) bool {
+	if normaliseAddress(m.Details) == address {
+		return true
+	}
+	for _, f := range m.Fields {
+		if f.Type == config.FIELD_EMAIL && normaliseAddress(f.Value) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ids of the mail logs submitted with email. Addresses are
+// compared whole, so erasing bo@x.com doesn't touch jimbo@x.com.
+func (q SubjectQuery) mailLogsWithEmail(db *gorm.DB) ([]uint, error) {
+	address := normaliseAddress(q.Email)
+	if address == "" {
+		address = strings.ToLower(strings.TrimSpace(q.Email))
+	}
+	var candidates []MailLog
+	err := db.Model(&MailLog{}).Select("id, details, fields").
+		Where("INSTR(LOWER(details), ?) > 0 OR INSTR(fields, ?) > 0", address, `"Type":"email"`).
+		Find(&candidates).Error
+	var ids []uint
+	for _, m := range candidates {
+		if m.hasAddress(address) {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, err
+}
+
+func (q SubjectQuery) mailLogs(db *gorm.DB) (*gorm.DB, error) {
+	var conds []string
+	var args []any
+	if q.Email != "" {
+		ids, err := q.mailLogsWithEmail(db)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, "id IN ?")
+		args = append(args, ids)
+	}
+	if q.Name != "" {
+		conds = append(conds, "LOWER(name) = ?")
+		args = append(args, strings.ToLower(q.Name))
+	}
+	if len(q.IPs) > 0 {
+		conds = append(conds, "ip IN ?")
+		args = append(args, q.IPs)
+	}
+	return orWhere(db.Model(&MailLog{}), conds, args), nil
+}
+
+func (q SubjectQuery) eventLogs(db *gorm.DB) *gorm.DB {
+	var conds []string
+	var args []any
+	if len(q.IPs) > 0 {
+		conds = append(conds, "ip IN ?")
+		args = append(args, q.IPs)
+	}
+	if q.SessionID != "" {
+		conds = append(conds, "json_extract(raw_event, '$.SessionId') = ?")
+		args = append(args, q.SessionID)
+	}
+	return orWhere(db.Model(&EventLog{}), conds, args)
+}
+
+// All data held about a subject.
+type SubjectData struct {
+	MailLogs  []MailLog
+	EventLogs []EventLog
+}
+
+// Returns all rows matching q.
+func FindSubjectData(q SubjectQuery) (SubjectData, error) {
+	conn := Current()
+	rv := SubjectData{MailLogs: []MailLog{}, EventLogs: []EventLog{}}
+	if conn == nil {
+		return rv, errors.New("no database available")
+	}
+	if q.IsEmpty() {
+		return rv, errors.New("no search criteria provided")
+	}
+	tx, err := q.mailLogs(conn)
+	if err != nil {
+		return rv, fmt.Errorf("could not find mail logs: %w", err)
+	}
+	if tx != nil {
+		if err := tx.Find(&rv.MailLogs).Error; err != nil {
+			return rv, fmt.Errorf("could not find mail logs: %w", err)
+		}
+	}
+	if tx := q.eventLogs(conn); tx != nil {
+		if err := tx.Find(&rv.EventLogs).Error; err != nil {
+			return rv, fmt.Errorf("could not find event logs: %w", err)
+		}
+	}
+	return rv, nil
+}
+
+type ErasureAction string
+
+const (
+	ERASE_DELETE ErasureAction = "delete" // Delete matching rows.
+	ERASE_REDACT ErasureAction = "redact" // Blank identifying fields, keeping the rows for aggregate stats.
+)
+
+// Audit record of an erasure.
+//
+// Only the type of criteria used is recorded, not their values, so the record
+// itself holds no personal data.
+type Erasure struct {
+	ID          uint `gorm:"primarykey"`
+	When        time.Time
+	Action      ErasureAction
+	Criteria    string
+	Reason      string
+	RequestedBy string
+	MailLogs    int64
+	QueuedMail  int64
+	EventLogs   int64
+}
+
+// Deletes or redacts all rows matching q, recording an Erasure.
+func EraseSubjectData(q SubjectQuery, action ErasureAction, reason, requestedBy string) (Erasure, error) {
+	conn := Current()
+	rv := Erasure{
+		When:        time.Now(),
+		Action:      action,
+		Criteria:    q.criteria(),
+		Reason:      reason,
+		RequestedBy: requestedBy,
+	}
+	if conn == nil {
+		return rv, errors.New("no database available")
+	}
+	if q.IsEmpty() {
+		return rv, errors.New("no search criteria provided")
+	}
+	if action != ERASE_DELETE && action != ERASE_REDACT {
+		return rv, fmt.Errorf("unknown erasure action %q", action)
+	}
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		mq, err := q.mailLogs(tx)
+		if err != nil {
+			return fmt.Errorf("could not find mail logs: %w", err)
+		}
+		if mq != nil {
+			var ids []uint
+			if err := mq.Pluck("id", &ids).Error; err != nil {
+				return fmt.Errorf("could not find mail logs: %w", err)
+			}
+			// Queued mail is a copy of the message, so is deleted either way.
+			res := tx.Where("mail_log_id IN ?", ids).Delete(&QueuedMail{})
+			if res.Error != nil {
+				return fmt.Errorf("could not erase queued mail: %w", res.Error)
+			}
+			rv.QueuedMail = res.RowsAffected
+
+			mq = tx.Model(&MailLog{}).Where("id IN ?", ids)
+			if action == ERASE_DELETE {
+				res = mq.Delete(&MailLog{})
+			} else {
+				res = mq.Updates(map[string]any{
+					"name":    Redacted,
+					"org":     Redacted,
+					"details": Redacted,
+					"msg":     Redacted,
+					"ip":      "",
+					// Keeping which fields were submitted.
+					"fields": gorm.Expr("(SELECT json_group_array(json_set(value, '$.Value', ?)) FROM json_each(fields))", Redacted),
+				})
+			}
+			if res.Error != nil {
+				return fmt.Errorf("could not erase mail logs: %w", res.Error)
+			}
+			rv.MailLogs = res.RowsAffected
+		}
+		if eq := q.eventLogs(tx); eq != nil {
+			var res *gorm.DB
+			if action == ERASE_DELETE {
+				res = eq.Delete(&EventLog{})
+			} else {
+				res = eq.Updates(map[string]any{
+					"ip":            "",
+					"visitor_id":    "",
+					"user_agent_id": 0,
+					"region":        "",
+					"city":          "",
+					"session_id":    "",
+					"raw_event":     gorm.Expr("json_remove(raw_event, '$.SessionId')"),
+				})
+			}
+			if res.Error != nil {
+				return fmt.Errorf("could not erase event logs: %w", res.Error)
+			}
+			rv.EventLogs = res.RowsAffected
+		}
+		return tx.Create(&rv).Error
+	})
+	return rv, err
+}
+
+func init() {
+	register(&Erasure{})
+}
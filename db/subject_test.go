@@ -0,0 +1,116 @@
+package db
+
+import (
+	"testing"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/metrics"
+)
+
+func Test_SubjectData(t *testing.T) {
+	Init(config.Config{
+		DatabaseUrl: "file::memory:?cache=shared",
+	})
+
+	for _, m := range []MailLog{
+		{Host: "subject.com", Name: "Jo Bloggs", Details: "Jo@Example.com", Msg: "hi", IP: "10.20.30.40"},
+		{Host: "subject.com", Name: "Someone Else", Details: "else@example.com", Msg: "hi", IP: "10.20.30.41"},
+		// From a form without the default fields.
+		{Host: "subject.com", Fields: FormValues{
+			{Name: "email", Type: config.FIELD_EMAIL, Value: "JO@example.com"},
+			{Name: "phone", Type: config.FIELD_PHONE, Value: "021 555 1234"},
+		}, IP: "10.20.30.42"},
+		// Addresses containing Jo's, which aren't Jo's.
+		{Host: "subject.com", Name: "Tojo", Details: "tojo@example.com", Msg: "near", IP: "10.20.30.43"},
+		{Host: "subject.com", Name: "Mojo", Fields: FormValues{
+			{Name: "email", Type: config.FIELD_EMAIL, Value: "Mojo <mojo@example.com>"},
+			{Name: "note", Value: "cc jo@example.com"},
+		}, Msg: "near", IP: "10.20.30.44"},
+	} {
+		if err := Create(&m).Error; err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+	for _, e := range []EventLog{
+		{Host: "subject.com", IP: "10.20.30.40", VisitorID: "v1", Country: "NZ", Region: "Wellington", City: "Wellington", SessionID: "s1", RawEvent: metrics.JsonEvent{Event: metrics.EV_PAGEVIEW, SessionId: "s1"}},
+		{Host: "subject.com", IP: "10.20.30.99", VisitorID: "v2", RawEvent: metrics.JsonEvent{Event: metrics.EV_PAGEVIEW, SessionId: "s2"}},
+		{Host: "subject.com", IP: "10.20.30.98", VisitorID: "v3", RawEvent: metrics.JsonEvent{Event: metrics.EV_PAGEVIEW, SessionId: "s3"}},
+	} {
+		if err := Create(&e).Error; err != nil {
+			t.Fatal("Expected no error, got", err)
+		}
+	}
+
+	jo := MailLog{}
+	if err := Current().Where("name = ?", "Jo Bloggs").First(&jo).Error; err != nil {
+		t.Fatal("Could not find mail log:", err)
+	}
+	if err := QueueMail(&QueuedMail{MailLogID: jo.ID, Host: "subject.com", Body: []byte("hi")}); err != nil {
+		t.Fatal("Could not queue mail:", err)
+	}
+
+	if _, err := FindSubjectData(SubjectQuery{}); err == nil {
+		t.Error("Expected error for empty query, got nil")
+	}
+
+	q := SubjectQuery{Email: "jo@example.com", IPs: []string{"10.20.30.40"}, SessionID: "s2"}
+	data, err := FindSubjectData(q)
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if len(data.MailLogs) != 2 || data.MailLogs[0].Name != "Jo Bloggs" || data.MailLogs[1].Fields.Get("phone") != "021 555 1234" {
+		t.Errorf("Expected Jo's mail logs, got %+v", data.MailLogs)
+	}
+	if len(data.EventLogs) != 2 {
+		t.Errorf("Expected 2 event logs, got %+v", data.EventLogs)
+	}
+
+	erasure, err := EraseSubjectData(q, ERASE_REDACT, "request", "test")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if erasure.MailLogs != 2 || erasure.QueuedMail != 1 || erasure.EventLogs != 2 || erasure.Criteria != "email,ip,session" {
+		t.Errorf("Unexpected erasure record: %+v", erasure)
+	}
+	m := MailLog{}
+	if err := Current().Where("host = ? AND msg = ?", "subject.com", Redacted).First(&m).Error; err != nil {
+		t.Fatal("Could not find redacted mail log:", err)
+	}
+	if m.Name != Redacted || m.Details != Redacted || m.IP != "" {
+		t.Errorf("Expected mail log to be redacted, got %+v", m)
+	}
+	m = MailLog{}
+	if err := Current().Where("host = ? AND name = ?", "subject.com", Redacted).Last(&m).Error; err != nil {
+		t.Fatal("Could not find redacted mail log:", err)
+	}
+	if len(m.Fields) != 2 || m.Fields[0].Name != "email" || m.Fields.Get("email") != Redacted || m.Fields.Get("phone") != Redacted {
+		t.Errorf("Expected mail log fields to be redacted, got %+v", m.Fields)
+	}
+	if c, _ := Count(&MailLog{}, "host = ? AND msg = ? AND ip != ''", "subject.com", "near"); c != 2 {
+		t.Error("Expected mail logs from similar addresses to survive, got", c)
+	}
+	e := EventLog{}
+	if err := Current().Where("host = ? AND visitor_id = ?", "subject.com", "").First(&e).Error; err != nil {
+		t.Fatal("Could not find redacted event log:", err)
+	}
+	if e.IP != "" || e.Region != "" || e.City != "" || e.SessionID != "" || e.RawEvent.SessionId != "" || e.RawEvent.Event != metrics.EV_PAGEVIEW {
+		t.Errorf("Expected event log to be redacted, got %+v", e)
+	}
+
+	erasure, err = EraseSubjectData(SubjectQuery{Name: "someone else", SessionID: "s3"}, ERASE_DELETE, "", "test")
+	if err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if erasure.MailLogs != 1 || erasure.EventLogs != 1 {
+		t.Errorf("Unexpected erasure record: %+v", erasure)
+	}
+	if c, _ := Count(&MailLog{}, "host = ?", "subject.com"); c != 4 {
+		t.Error("Expected 4 mail logs remaining, got", c)
+	}
+	if c, _ := Count(&EventLog{}, "host = ?", "subject.com"); c != 2 {
+		t.Error("Expected 2 event logs remaining, got", c)
+	}
+	if c, _ := Count(&Erasure{}, "requested_by = ?", "test"); c != 2 {
+		t.Error("Expected 2 erasure records, got", c)
+	}
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Secret salt used to compute visitor IDs for a single (UTC) day.
+//
+// Salts are deleted once their day has ended so that visitor IDs can't be
+// recomputed or linked across days.
+type Salt struct {
+	ID   uint `gorm:"primarykey"`
+	Day  string
+	Salt []byte
+}
+
+var saltMu sync.Mutex
+var currentSalt Salt
+
+func saltDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// Returns the salt for the day of t, creating it (and destroying any older
+// salts) if needed. Without a DB the salt is only held in memory.
+func dailySalt(t time.Time) ([]byte, error) {
+	conn := Current()
+	day := saltDay(t)
+	saltMu.Lock()
+	defer saltMu.Unlock()
+	if currentSalt.Day == day {
+		return currentSalt.Salt, nil
+	}
+	s := Salt{}
+	if conn != nil {
+		if err := conn.Where("day < ?", day).Delete(&Salt{}).Error; err != nil {
+			log.Printf("Could not delete expired visitor salts: %v", err)
+		}
+		if err := conn.Where("day = ?", day).Limit(1).Find(&s).Error; err != nil {
+			return nil, err
+		}
+	}
+	if s.Day == "" {
+		s = Salt{Day: day, Salt: make([]byte, 32)}
+		if _, err := rand.Read(s.Salt); err != nil {
+			return nil, err
+		}
+		if err := Create(&s).Error; err != nil {
+			return nil, err
+		}
+	}
+	currentSalt = s
+	return s.Salt, nil
+}
+
+// Returns an anonymous identifier for a visitor to host on the day of t.
+//
+// The ID is a hash of the daily salt, host, IP and User-Agent, so it is
+// stable for a visitor within a day but can't be reversed or tracked across
+// days or sites. Returns an empty string if no salt is available.
+func VisitorID(t time.Time, host, ip, userAgent string) string {
+	salt, err := dailySalt(t)
+	if err != nil {
+		log.Printf("Could not get visitor salt: %v", err)
+		return ""
+	}
+	h := sha256.New()
+	h.Write(salt)
+	for _, v := range []string{host, ip, userAgent} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func init() {
+	register(&Salt{})
+}
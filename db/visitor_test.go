@@ -0,0 +1,50 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+)
+
+func Test_VisitorID(t *testing.T) {
+	Init(config.Config{
+		DatabaseUrl: "file::memory:?cache=shared",
+	})
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	old := VisitorID(yesterday, "test.com", "10.10.10.10", "browser")
+	if old == "" {
+		t.Fatal("Expected non-empty visitor ID")
+	}
+
+	now := time.Now()
+	id := VisitorID(now, "test.com", "10.10.10.10", "browser")
+	if id == "" {
+		t.Fatal("Expected non-empty visitor ID")
+	}
+	if id == old {
+		t.Error("Expected visitor ID to change between days")
+	}
+	if id2 := VisitorID(now, "test.com", "10.10.10.10", "browser"); id2 != id {
+		t.Errorf("Expected same visitor ID, got %s and %s", id, id2)
+	}
+	for _, other := range []string{
+		VisitorID(now, "another.com", "10.10.10.10", "browser"),
+		VisitorID(now, "test.com", "10.10.10.11", "browser"),
+		VisitorID(now, "test.com", "10.10.10.10", "browser2"),
+	} {
+		if other == id {
+			t.Error("Expected different visitor ID")
+		}
+	}
+
+	// Yesterday's salt should have been destroyed.
+	var salts []Salt
+	if err := Current().Find(&salts).Error; err != nil {
+		t.Fatal("Error finding salts:", err)
+	}
+	if len(salts) != 1 || salts[0].Day != saltDay(now) {
+		t.Errorf("Expected only today's salt to remain, got %v", salts)
+	}
+}
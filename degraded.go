@@ -0,0 +1,104 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/spool"
+)
+
+var (
+	// Delays between attempts to open the database, doubling from min to max.
+	dbRetryMin = time.Second
+	dbRetryMax = 5 * time.Minute
+	// How often to retry storing spooled events after failing to.
+	spoolRetryInterval = 10 * time.Second
+)
+
+// Writes e to the spool, to be stored in the database by consumeSpool. If the
+// spool isn't available, e is stored directly.
+func storeEvent(e db.PendingEvent) {
+	err := spool.Append(e)
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, spool.ErrDisabled) {
+		log.Printf("Could not spool event, storing it directly: %v", err)
+	}
+	if db.Current() == nil {
+		log.Printf("No DB available, dropping event")
+		return
+	}
+	if err := db.StoreEvent(e); err != nil {
+		log.Printf("Could not log raw event: %v", err)
+	}
+}
+
+// Opens the database, retrying with backoff until it succeeds or ctx is done.
+func connectDB(ctx context.Context, conf config.Config) {
+	delay := dbRetryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := db.Init(conf)
+		if err == nil {
+			log.Printf("Database now available, leaving degraded mode")
+			return
+		}
+		delay = min(2*delay, dbRetryMax)
+		log.Printf("Database still unavailable, retrying in %s: %v", delay, err)
+	}
+}
+
+// Stores spooled events in the database as they're appended (or every
+// spoolRetryInterval after failing) until ctx is done, when any remaining are
+// stored before returning.
+func consumeSpool(ctx context.Context) {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		done := false
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-spool.Appended():
+		case <-ticker.C:
+		}
+		if n, _ := spool.Pending(); n > 0 && db.Current() != nil {
+			if n, err := spool.Consume(storeSpooled); err != nil {
+				log.Printf("Stored %d spooled events before failing: %v", n, err)
+			}
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// Stores a spooled event. Events which fail to store while the database is
+// otherwise healthy are dropped, so they can't block the rest of the spool.
+func storeSpooled(record []byte) error {
+	e := db.PendingEvent{}
+	if err := json.Unmarshal(record, &e); err != nil {
+		log.Printf("Dropping corrupt spooled event %q: %v", record, err)
+		return nil
+	}
+	err := db.StoreEvent(e)
+	if err == nil {
+		return nil
+	}
+	if checkErr := db.Check(context.Background()); checkErr != nil {
+		return errors.Join(err, checkErr)
+	}
+	log.Printf("Dropping spooled event which could not be stored: %v", err)
+	return nil
+}
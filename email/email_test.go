@@ -0,0 +1,103 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Line breaks in the body are sent as CRLF.
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+func Test_Message(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	m := Message{
+		From:    mail.Address{Name: "Web Site", Address: "web@example.com"},
+		To:      []mail.Address{{Address: "a@example.com"}, {Name: "Bé", Address: "b@example.com"}},
+		ReplyTo: &mail.Address{Name: "Zoë Ünïcode", Address: "zoe@example.org"},
+		Subject: "Hello from Zoë",
+		Date:    date,
+		Text:    "Hi,\nnon-ASCII: ✓ and a long line " + strings.Repeat("x", 100),
+		HTML:    "<p>Hi &amp; ✓</p>",
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Could not parse message: %v\n%s", err, b)
+	}
+	dec := new(mime.WordDecoder)
+	if s, err := dec.DecodeHeader(msg.Header.Get("Subject")); err != nil || s != m.Subject {
+		t.Errorf("Expected subject %q, got %q (%v)", m.Subject, s, err)
+	}
+	if to, err := msg.Header.AddressList("To"); err != nil || len(to) != 2 || to[1].Name != "Bé" {
+		t.Errorf("Expected 2 recipients, got %v (%v)", to, err)
+	}
+	if r, err := mail.ParseAddress(msg.Header.Get("Reply-To")); err != nil || r.Name != "Zoë Ünïcode" || r.Address != "zoe@example.org" {
+		t.Errorf("Expected Reply-To to be Zoë, got %v (%v)", r, err)
+	}
+	if d, err := msg.Header.Date(); err != nil || !d.Equal(date) {
+		t.Errorf("Expected date %s, got %s (%v)", date, d, err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("Expected Message-ID in example.com, got %q", id)
+	}
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("Line too long: %q", line)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Expected multipart/alternative, got %s (%v)", mediaType, err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		part, err := r.NextRawPart()
+		if err != nil {
+			t.Fatalf("Expected %s part: %v", want.contentType, err)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != want.contentType {
+			t.Errorf("Expected %s, got %s", want.contentType, ct)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil || crlf(string(body)) != crlf(want.body) {
+			t.Errorf("Expected %s body %q, got %q (%v)", want.contentType, want.body, body, err)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Error("Expected only 2 parts, got", err)
+	}
+
+	// Text only.
+	m.HTML = ""
+	m.ReplyTo = nil
+	b, err = m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" || msg.Header.Get("Reply-To") != "" {
+		t.Errorf("Expected plain text without Reply-To, got %s", b)
+	}
+	if body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body)); crlf(string(body)) != crlf(m.Text) {
+		t.Errorf("Expected body %q, got %q", m.Text, body)
+	}
+}
@@ -0,0 +1,95 @@
+// Offline IP geolocation using a local MaxMind format (MMDB) database, such as
+// GeoLite2-City or DB-IP's City Lite.
+package geoip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"mattb.nz/web/metrics/config"
+)
+
+// Open database, nil if geolocation is not configured.
+var reader *maxminddb.Reader
+
+// Guards reader, so it isn't closed during a lookup.
+var mu sync.RWMutex
+
+type Location struct {
+	Country string // ISO 3166-1 alpha-2 country code
+	Region  string // Name of the first subdivision (state, region, ...)
+	City    string
+}
+
+// Subset of the GeoIP2 City/Country record that we use.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// Opens the configured database, if any, replacing any already open.
+//
+// On error the previously open database (if any) remains in use.
+func Init(conf config.Config) error {
+	if conf.GeoIPDatabase == "" {
+		Close()
+		return nil
+	}
+	r, err := maxminddb.Open(conf.GeoIPDatabase)
+	if err != nil {
+		return fmt.Errorf("could not open GeoIP database: %w", err)
+	}
+	Close()
+	mu.Lock()
+	reader = r
+	mu.Unlock()
+	log.Printf("Loaded GeoIP database %s (%s, built %d)", conf.GeoIPDatabase, r.Metadata.DatabaseType, r.Metadata.BuildEpoch)
+	return nil
+}
+
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if reader != nil {
+		reader.Close()
+		reader = nil
+	}
+}
+
+// Returns true if a database is available for lookups.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return reader != nil
+}
+
+// Looks up the location of ip, returning an empty Location if it is unknown
+// or no database is configured.
+func Lookup(ip string) Location {
+	addr := net.ParseIP(ip)
+	mu.RLock()
+	defer mu.RUnlock()
+	if reader == nil || addr == nil {
+		return Location{}
+	}
+	rec := record{}
+	if err := reader.Lookup(addr, &rec); err != nil {
+		log.Printf("GeoIP lookup for %s failed: %v", ip, err)
+		return Location{}
+	}
+	loc := Location{Country: rec.Country.ISOCode, City: rec.City.Names["en"]}
+	if len(rec.Subdivisions) > 0 {
+		loc.Region = rec.Subdivisions[0].Names["en"]
+	}
+	return loc
+}
@@ -0,0 +1,38 @@
+package geoip
+
+import (
+	"testing"
+
+	"mattb.nz/web/metrics/config"
+)
+
+// testdata/test-city.mmdb was generated with github.com/maxmind/mmdbwriter and
+// contains 81.2.69.0/24 (GB), 202.36.0.0/16 (NZ) and 2001:db8::/32 (NZ).
+func Test_Lookup(t *testing.T) {
+	if Enabled() || Lookup("81.2.69.1") != (Location{}) {
+		t.Error("Expected no lookups before Init")
+	}
+	if err := Init(config.Config{GeoIPDatabase: "testdata/doesnotexist.mmdb"}); err == nil {
+		t.Error("Expected error opening missing database, got nil")
+	}
+	if err := Init(config.Config{GeoIPDatabase: "testdata/test-city.mmdb"}); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	defer Close()
+
+	tests := []struct {
+		ip   string
+		want Location
+	}{
+		{"81.2.69.142", Location{"GB", "England", "London"}},
+		{"202.36.1.2", Location{"NZ", "Wellington Region", "Wellington"}},
+		{"2001:db8::1", Location{"NZ", "Canterbury", "Christchurch"}},
+		{"8.8.8.8", Location{}},
+		{"not-an-ip", Location{}},
+	}
+	for _, test := range tests {
+		if got := Lookup(test.ip); got != test.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", test.ip, got, test.want)
+		}
+	}
+}
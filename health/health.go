@@ -0,0 +1,194 @@
+// Health checks of the components the service depends on, summarised by
+// /healthz and /readyz, reported in full on the admin surface and exported to
+// Prometheus.
+//
+// Checks dial out and write to the database, so they're run every Interval
+// by Monitor rather than for each request; reporting uses Latest.
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Checks a component, returning nil if it is healthy.
+type Check func(ctx context.Context) error
+
+// Checks a component as for Check, also returning details of its state (such
+// as a backlog) to include in its Status whether or not it is healthy.
+type DetailedCheck func(ctx context.Context) (map[string]any, error)
+
+// Returned by a Check for a component which isn't configured.
+var ErrDisabled = errors.New("not configured")
+
+// How long each check may take before it is considered failed.
+var Timeout = 2 * time.Second
+
+// How often Monitor runs the checks.
+var Interval = 15 * time.Second
+
+const (
+	STATUS_OK       = "ok"       // Healthy.
+	STATUS_FAIL     = "fail"     // Check failed.
+	STATUS_DISABLED = "disabled" // Not configured.
+	// Overall only: a component which isn't critical is failing.
+	STATUS_DEGRADED = "degraded"
+)
+
+type component struct {
+	name     string
+	critical bool
+	check    DetailedCheck
+}
+
+var (
+	mu         sync.Mutex
+	components []component
+)
+
+// Registers the check for the named component, replacing any existing one.
+// The service isn't ready while a critical component is failing.
+func Register(name string, critical bool, check Check) {
+	RegisterDetailed(name, critical, func(ctx context.Context) (map[string]any, error) {
+		return nil, check(ctx)
+	})
+}
+
+// Registers a check reporting details, as for Register.
+func RegisterDetailed(name string, critical bool, check DetailedCheck) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, c := range components {
+		if c.name == name {
+			components[i] = component{name, critical, check}
+			return
+		}
+	}
+	components = append(components, component{name, critical, check})
+}
+
+// The result of checking a component.
+type Status struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	// Reported by a DetailedCheck.
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// The results of checking all components.
+type Report struct {
+	Status     string            `json:"status"` // STATUS_OK, STATUS_DEGRADED or STATUS_FAIL
+	Components map[string]Status `json:"components"`
+}
+
+// Returns true unless a critical component is failing.
+func (r Report) Ready() bool {
+	return r.Status != STATUS_FAIL
+}
+
+// Checks all components concurrently.
+func Run(ctx context.Context) Report {
+	mu.Lock()
+	checks := append([]component(nil), components...)
+	mu.Unlock()
+
+	statuses := make([]Status, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, Timeout)
+			defer cancel()
+			statuses[i] = run(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: STATUS_OK, Components: make(map[string]Status)}
+	for i, c := range checks {
+		s := statuses[i]
+		report.Components[c.name] = s
+		if s.Status != STATUS_FAIL {
+			continue
+		}
+		if c.critical {
+			report.Status = STATUS_FAIL
+		} else if report.Status == STATUS_OK {
+			report.Status = STATUS_DEGRADED
+		}
+	}
+	return report
+}
+
+// Runs the check for c, giving up once ctx is done even if the check doesn't.
+func run(ctx context.Context, c component) Status {
+	type result struct {
+		details map[string]any
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		details, err := c.check(ctx)
+		done <- result{details, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+	err := r.err
+	s := Status{Status: STATUS_OK, Critical: c.critical, Details: r.details}
+	if errors.Is(err, ErrDisabled) {
+		s.Status = STATUS_DISABLED
+	} else if err != nil {
+		s.Status = STATUS_FAIL
+		s.Error = err.Error()
+	}
+	return s
+}
+
+var (
+	latest    atomic.Pointer[Report]
+	refreshMu sync.Mutex // Held while running the first checks for Latest
+)
+
+// Checks all components, storing the result for Latest.
+func Refresh(ctx context.Context) Report {
+	r := Run(ctx)
+	latest.Store(&r)
+	return r
+}
+
+// Returns the result of the last Refresh, checking all components first if
+// they haven't been yet.
+func Latest() Report {
+	if r := latest.Load(); r != nil {
+		return *r
+	}
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if r := latest.Load(); r != nil {
+		return *r
+	}
+	return Refresh(context.Background())
+}
+
+// Refreshes the result of the checks every Interval until ctx is done.
+func Monitor(ctx context.Context) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Run(t *testing.T) {
+	components = nil
+	Timeout = 50 * time.Millisecond
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("broken") }
+
+	Register("db", true, ok)
+	Register("mail", false, func(ctx context.Context) error { return ErrDisabled })
+	if r := Run(context.Background()); r.Status != STATUS_OK || !r.Ready() {
+		t.Errorf("Expected ok, got %+v", r)
+	}
+
+	Register("ts", false, fail)
+	RegisterDetailed("queue", false, func(ctx context.Context) (map[string]any, error) {
+		return map[string]any{"pending": 2}, nil
+	})
+	r := Run(context.Background())
+	if r.Status != STATUS_DEGRADED || !r.Ready() {
+		t.Errorf("Expected degraded but ready, got %+v", r)
+	}
+	want := map[string]Status{
+		"db":    {Status: STATUS_OK, Critical: true},
+		"mail":  {Status: STATUS_DISABLED},
+		"ts":    {Status: STATUS_FAIL, Error: "broken"},
+		"queue": {Status: STATUS_OK, Details: map[string]any{"pending": 2}},
+	}
+	for name, s := range want {
+		if !reflect.DeepEqual(r.Components[name], s) {
+			t.Errorf("Expected %s to be %+v, got %+v", name, s, r.Components[name])
+		}
+	}
+
+	// Re-registering replaces the check.
+	Register("db", true, func(ctx context.Context) error {
+		time.Sleep(time.Second) // Ignores ctx, but still times out.
+		return nil
+	})
+	start := time.Now()
+	r = Run(context.Background())
+	if r.Status != STATUS_FAIL || r.Ready() || len(r.Components) != 4 {
+		t.Errorf("Expected fail, got %+v", r)
+	}
+	if r.Components["db"].Error != context.DeadlineExceeded.Error() {
+		t.Error("Expected db to time out, got", r.Components["db"])
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Expected Run to give up after Timeout, took", time.Since(start))
+	}
+}
+
+func Test_Latest(t *testing.T) {
+	components = nil
+	latest.Store(nil)
+	var runs atomic.Int32
+	Register("db", true, func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+	// Checked once on first use, then the result is reused.
+	for i := 0; i < 3; i++ {
+		if r := Latest(); r.Status != STATUS_OK {
+			t.Errorf("Expected ok, got %+v", r)
+		}
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("Expected checks to run once, ran %d times", n)
+	}
+
+	Register("db", true, func(ctx context.Context) error { return errors.New("broken") })
+	if r := Latest(); r.Status != STATUS_OK {
+		t.Errorf("Expected cached result until refreshed, got %+v", r)
+	}
+	Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		Monitor(ctx)
+		close(done)
+	}()
+	for start := time.Now(); Latest().Status != STATUS_FAIL; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected Monitor to refresh the result")
+		}
+	}
+	cancel()
+	<-done
+}
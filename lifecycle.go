@@ -0,0 +1,103 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/geoip"
+	"mattb.nz/web/metrics/spool"
+	"mattb.nz/web/metrics/tailscale"
+)
+
+// Set once startup completes, and cleared when shutdown begins, see Readyz.
+var ready atomic.Bool
+
+// Background work (started with runBackground) which shutdown waits for.
+var background sync.WaitGroup
+
+var (
+	// How long to keep serving after becoming not ready, so load balancers
+	// polling /readyz stop sending new requests before we stop accepting them.
+	drainDelay = 5 * time.Second
+	// How long to wait for in-flight requests and background work to finish.
+	shutdownTimeout = 20 * time.Second
+)
+
+// Runs f in a goroutine which shutdown waits for. f must return once ctx is
+// done.
+func runBackground(ctx context.Context, f func(ctx context.Context)) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f(ctx)
+	}()
+}
+
+// Runs serve (e.g. srv.ListenAndServe) in a goroutine tracked by wg, logging
+// if it stops for any reason other than shutdown.
+func startServer(wg *sync.WaitGroup, name string, serve func() error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s server failed: %v", name, err)
+		}
+	}()
+}
+
+// Gracefully stops the service: flips /readyz to not ready, waits drainDelay,
+// then stops servers accepting new connections and waits for in-flight
+// requests and background work (whose context stopBackground cancels) to
+// finish, up to shutdownTimeout.
+func shutdown(stopBackground context.CancelFunc, servers ...*http.Server) error {
+	ready.Store(false)
+	log.Printf("Shutting down, draining for %s", drainDelay)
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+
+	stopBackground()
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, errors.New("timed out waiting for background work"))
+	}
+	return errors.Join(errs...)
+}
+
+// Releases resources held by the service, once shutdown has completed.
+func closeResources() {
+	if err := db.Close(); err != nil {
+		log.Printf("Could not close database: %v", err)
+	}
+	geoip.Close()
+	if err := spool.Close(); err != nil {
+		log.Printf("Could not close spool: %v", err)
+	}
+	if err := tailscale.Close(); err != nil {
+		log.Printf("Could not close Tailscale: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+)
+
+var (
+	// Delays between attempts to send mail, doubling from min to max.
+	mailRetryMin = time.Minute
+	mailRetryMax = 6 * time.Hour
+	// Attempts after which mail is given up on, until manually resent.
+	mailMaxAttempts = 10
+	// How often the queue is checked for mail due to be retried.
+	mailQueueInterval = 30 * time.Second
+	// Maximum mail sent each time the queue is processed.
+	mailBatchSize = 50
+)
+
+// Receives when mail is queued, so it's sent without waiting for the next
+// interval.
+var mailQueued = make(chan struct{}, 1)
+
+// Queues m to be sent by processMailQueue. If the database is unavailable, m
+// is sent immediately instead, without retries.
+func queueMail(m db.QueuedMail) error {
+	if db.Current() == nil {
+		return sendMail(m)
+	}
+	if err := db.QueueMail(&m); err != nil {
+		return fmt.Errorf("could not queue mail: %w", err)
+	}
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func sendMail(m db.QueuedMail) error {
+	mail := config.Current().Mail
+	var auth smtp.Auth
+	if mail.User != "" {
+		auth = smtp.PlainAuth("", mail.User, mail.Password, mail.Host)
+	}
+	return smtp.SendMail(mail.Addr(), auth, m.From, m.Recipients(), m.Body)
+}
+
+// Returns how long to wait before retrying mail which has failed attempts
+// times.
+func mailRetryDelay(attempts int) time.Duration {
+	delay := mailRetryMin
+	for i := 1; i < attempts && delay < mailRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, mailRetryMax)
+}
+
+// Attempts to send all mail that is due, returning the number sent.
+func sendDueMail() int {
+	due, err := db.DueMail(time.Now(), mailBatchSize)
+	if err != nil {
+		log.Printf("Could not check mail queue: %v", err)
+		return 0
+	}
+	sent := 0
+	for _, m := range due {
+		err := sendMail(m)
+		if err == nil {
+			sent++
+			if err := db.MailSent(&m); err != nil {
+				log.Printf("Could not mark mail %d sent: %v", m.ID, err)
+			}
+			continue
+		}
+		var next time.Time
+		if m.Attempts+1 < mailMaxAttempts {
+			next = time.Now().Add(mailRetryDelay(m.Attempts + 1))
+			log.Printf("Failed to send mail %d for %s to %s, retrying at %s: %v", m.ID, m.Host, m.To, next.Format(time.RFC3339), err)
+		} else {
+			log.Printf("Failed to send mail %d for %s to %s, giving up after %d attempts: %v", m.ID, m.Host, m.To, m.Attempts+1, err)
+		}
+		if err := db.MailFailed(&m, err, next); err != nil {
+			log.Printf("Could not record mail %d failure: %v", m.ID, err)
+		}
+	}
+	return sent
+}
+
+// Sends queued mail as it's queued and retries failures every
+// mailQueueInterval, until ctx is done.
+func processMailQueue(ctx context.Context) {
+	ticker := time.NewTicker(mailQueueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mailQueued:
+		case <-ticker.C:
+		}
+		if db.Current() != nil {
+			sendDueMail()
+		}
+	}
+}
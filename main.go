@@ -4,31 +4,37 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/smtp"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/admin"
 	"mattb.nz/web/metrics/config"
 	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/geoip"
+	"mattb.nz/web/metrics/health"
 	"mattb.nz/web/metrics/js"
 	"mattb.nz/web/metrics/metrics"
 	"mattb.nz/web/metrics/prom"
 	"mattb.nz/web/metrics/reporting"
+	"mattb.nz/web/metrics/spam"
+	"mattb.nz/web/metrics/spool"
 	"mattb.nz/web/metrics/tailscale"
-	"mattb.nz/web/metrics/templates"
 )
 
-var conf config.Config
-
 // write CORS headers for a request
 func writeCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
@@ -65,6 +71,11 @@ func requestIP(r *http.Request) string {
 	return ip
 }
 
+// returns true if the request carries a Do Not Track or Global Privacy Control signal.
+func hasPrivacySignal(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
 // returns the known origin and host if the request should continue, or empty strings in failure cases.
 //
 // Failure cases include either a request from an unknown origin, OR a pre-flight request
@@ -72,7 +83,8 @@ func requestIP(r *http.Request) string {
 // processing should not continue.
 func checkOriginCORS(w http.ResponseWriter, r *http.Request) (string, string) {
 	origin := r.Header.Get("Origin")
-	host := conf.GetHostForOrigin(origin)
+	site, _ := config.Current().GetHostForOrigin(origin)
+	host := site.Host
 	if host == "" {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("unknown host"))
@@ -89,11 +101,51 @@ func checkOriginCORS(w http.ResponseWriter, r *http.Request) (string, string) {
 	return origin, host
 }
 
-type contactData struct {
-	Name    string
-	Org     string
-	Details string
-	Msg     string
+// Returns the property of a submitted form named name, case insensitively.
+func formValue(form map[string]any, name string) any {
+	if v, ok := form[name]; ok {
+		return v
+	}
+	for k, v := range form {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Returns the string property of a submitted form named name, or "".
+func formString(form map[string]any, name string) string {
+	s, _ := formValue(form, name).(string)
+	return s
+}
+
+// Returns the values of the site's contact form fields in form, or the
+// problem with each invalid field, by name.
+func parseContactForm(site config.MonitoredSite, form map[string]any) (db.FormValues, map[string]string) {
+	var values db.FormValues
+	problems := make(map[string]string)
+	for _, f := range site.ContactFormFields() {
+		v, err := f.Value(formValue(form, f.Name))
+		if err != nil {
+			problems[f.Name] = err.Error()
+			continue
+		}
+		values = append(values, db.FormValue{Name: f.Name, Label: f.LabelOrDefault(), Type: f.Type, Value: v})
+	}
+	return values, problems
+}
+
+// Issues a token for a contact form, see spam.Issue.
+func ContactToken(w http.ResponseWriter, r *http.Request) {
+	origin, host := checkOriginCORS(w, r)
+	if origin == "" {
+		return
+	}
+	writeCORSHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(spam.Issue(host, time.Now()))
 }
 
 func ContactForm(w http.ResponseWriter, r *http.Request) {
@@ -106,62 +158,86 @@ func ContactForm(w http.ResponseWriter, r *http.Request) {
 	if origin == "" {
 		return
 	}
+	conf := config.Current()
 	to := conf.HostContacts(host)
 	if len(to) <= 0 {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
-	msg := contactData{}
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
+	form := map[string]any{}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&form); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("could not decode request body"))
 		return
 	}
+	site := conf.GetSite(host)
+	fields, problems := parseContactForm(site, form)
+	if len(problems) > 0 {
+		// So the form can show what needs fixing.
+		writeCORSHeaders(w, r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]any{"Errors": problems})
+		return
+	}
+
+	now := time.Now()
+	var text []string
+	for _, f := range fields {
+		text = append(text, f.Value)
+	}
+	score := spam.Check(host, spam.Submission{
+		// Spam defences, see spam.Submission. The honeypot is hidden from
+		// people.
+		Honeypot: formString(form, "website"),
+		Token:    formString(form, "token"),
+		Proof:    formString(form, "proof"),
+		Text:     text,
+	}, now)
 
 	// Log first
 	logEvent := db.MailLog{
-		When:    time.Now(),
-		Host:    host,
-		Name:    msg.Name,
-		Org:     msg.Org,
-		Details: msg.Details,
-		Msg:     msg.Msg,
-		IP:      requestIP(r),
-	}
-	if err := db.DB.Create(&logEvent).Error; err != nil {
+		When:        now,
+		Host:        host,
+		Fields:      fields,
+		Name:        fields.Get("name"),
+		Org:         fields.Get("org"),
+		Details:     fields.Get("details"),
+		Msg:         fields.Get("msg"),
+		IP:          conf.AnonymiseIP(host, requestIP(r)),
+		SpamScore:   score.Score,
+		SpamReasons: strings.Join(score.Reasons, ", "),
+	}
+	if err := db.Create(&logEvent).Error; err != nil {
 		log.Printf("Could not log contact data: %v", err)
 	}
 	sitedata := metrics.GetSiteData(host)
-	sitedata.EventCount[metrics.EV_EMAIL]++
-
-	// Then send email.
-	from := "web-contact@mkmba.nz" // Must be mkmba.nz until SES is out of sandbox.
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
+	if score.IsSpam(host) {
+		// Respond as normal, so spammers can't tell.
+		log.Printf("Not sending contact form submission for %s scored as spam (%d: %s)", host, score.Score, logEvent.SpamReasons)
+		sitedata.Ignore(string(config.IGNORE_SPAM))
+		writeCORSHeaders(w, r)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	sitedata.CountEvent(metrics.EV_EMAIL, geoip.Lookup(requestIP(r)).Country)
 
-	tmpl, err := templates.Get("contactform.tmpl")
+	// Then queue the email to send, and any acknowledgement.
+	mail, err := renderContactMail(site, logEvent)
 	if err != nil {
-		log.Printf("Could not load email template: %v", err)
-	} else {
-		data := map[string]any{
-			"From":  from,
-			"To":    to,
-			"Event": logEvent,
-		}
-		var buf bytes.Buffer
-		err := tmpl.Execute(&buf, data)
-		if err != nil {
-			log.Printf("Could not render email template: %v", err)
-		} else {
-			var auth smtp.Auth
-			if os.Getenv("SMTP_USER") != "" {
-				auth = smtp.PlainAuth("", os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"), smtpHost)
-			}
-			err = smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, buf.Bytes())
-			if err != nil {
-				log.Printf("Failed to send email for %s to %s: %s", host, to, err)
-			}
+		log.Printf("Could not render email for %s: %v", host, err)
+	} else if err := queueMail(mail); err != nil {
+		log.Printf("Failed to send email for %s to %s: %s", host, to, err)
+	}
+	status, err := queueAutoReply(site, logEvent, now)
+	if err != nil {
+		log.Printf("Could not send auto-reply for %s: %v", host, err)
+	}
+	if conn := db.Current(); conn != nil && status != db.AUTOREPLY_NONE && logEvent.ID != 0 {
+		if err := conn.Model(&logEvent).Update("auto_reply", status).Error; err != nil {
+			log.Printf("Could not log auto-reply: %v", err)
 		}
 	}
 
@@ -174,6 +250,7 @@ func CollectMetric(w http.ResponseWriter, r *http.Request) {
 	if origin == "" {
 		return
 	}
+	conf := config.Current()
 
 	// Unmarshal the request body into our Event struct.
 	event := metrics.JsonEvent{}
@@ -203,33 +280,58 @@ func CollectMetric(w http.ResponseWriter, r *http.Request) {
 	if page == "" {
 		page = origin
 	}
+	campaign, page := metrics.ExtractCampaign(page, conf.GetSite(host).StripCampaignParams)
 	referer := event.Referer
-	if referer == page {
+	if referer == page || referer == event.Page {
 		referer = "" // Don't both storing referer if its the triggering page.
 	}
 
 	ip := requestIP(r)
-	if conf.IsIgnoredIP(ip) {
-		log.Printf("Ignoring %v on %s from ignored IP %s", event, page, ip)
+	ua := r.Header.Get("User-Agent")
+	policy := config.PRIVACY_IGNORE
+	if hasPrivacySignal(r) {
+		policy = conf.GetSite(host).PrivacySignals
+	}
+	sitedata := metrics.GetSiteData(host)
+	// Must be looked up before the IP is anonymised.
+	loc := geoip.Lookup(ip)
+	if reason := conf.IgnoreReason(host, ip, page, ua); reason != config.IGNORE_NONE {
+		log.Printf("Ignoring %v on %s from %s (%s)", event, page, ip, reason)
+		sitedata.Ignore(string(reason))
+	} else if policy == config.PRIVACY_DROP {
+		sitedata.Suppress(event.Event)
+	} else if policy == config.PRIVACY_COUNT {
+		sitedata.Suppress(event.Event)
+		sitedata.CountEvent(event.Event, loc.Country)
 	} else {
 		// Trim page/referer from raw_event saved to save DB space
 		// (they're explicit columns)
 		event.Page = ""
 		event.Referer = ""
-		logEvent := db.EventLog{
-			When:        time.Now(),
-			Host:        host,
-			Page:        page,
-			Referer:     referer,
-			UserAgentID: db.GetUserAgentID(r.Header.Get("User-Agent")),
-			IP:          ip,
-			RawEvent:    event,
-		}
-		if err := db.DB.Create(&logEvent).Error; err != nil {
-			log.Printf("Could not log raw event: %v", err)
+		now := time.Now()
+		logEvent := db.PendingEvent{EventLog: db.EventLog{
+			When:     now,
+			Host:     host,
+			Page:     page,
+			Referer:  referer,
+			Country:  loc.Country,
+			RawEvent: event,
+		}}
+		if policy == config.PRIVACY_ANONYMISE {
+			// Keep the event, but nothing that could identify the visitor.
+			logEvent.RawEvent.SessionId = ""
+			sitedata.Suppress(event.Event)
+		} else {
+			logEvent.Region = loc.Region
+			logEvent.City = loc.City
+			logEvent.UserAgent = ua
+			logEvent.IP = conf.AnonymiseIP(host, ip)
+			logEvent.VisitorID = db.VisitorID(now, host, ip, ua)
 		}
-		sitedata := metrics.GetSiteData(host)
-		sitedata.EventCount[event.Event]++
+		logEvent.SetCampaign(campaign)
+		storeEvent(logEvent)
+		sitedata.CountEvent(event.Event, loc.Country)
+		sitedata.AddVisitor(now, logEvent.VisitorID)
 	}
 
 	writeCORSHeaders(w, r)
@@ -239,22 +341,55 @@ func CollectMetric(w http.ResponseWriter, r *http.Request) {
 func setupPublicHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/", CollectMetric)
 	mux.HandleFunc("/contact", ContactForm)
+	mux.HandleFunc("/contact/token", ContactToken)
 
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("all good"))
-	})
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", Readyz)
 
 	mux.Handle("/js/", http.StripPrefix("/js/", serveWithCORS(js.FileServer())))
 }
 
+// Only one collector may be registered, however many muxes are set up.
+var registerCollector sync.Once
+
+// Sets up the admin surface: the dashboard, /metrics and admin APIs. These
+// must be served behind adminHandler.
 func setupTSHandlers(mux *http.ServeMux) {
 	// register a prometheus metric exporter
-	collector := prom.Collector{}
-	prometheus.MustRegister(collector)
-	mux.Handle("/metrics", promhttp.Handler())
+	registerCollector.Do(func() {
+		prometheus.MustRegister(prom.Collector{})
+	})
+	mux.Handle("/metrics", access.RequireAll(promhttp.Handler()))
 	mux.HandleFunc("/dashboard", reporting.Home)
 	mux.HandleFunc("/dashboard/{site}", reporting.Site)
+	mux.HandleFunc("/dashboard/{site}/campaigns", reporting.Campaigns)
+	mux.HandleFunc("/dashboard/{site}/referers", reporting.Referers)
+	mux.HandleFunc("/dashboard/{site}/devices", reporting.Devices)
+	mux.HandleFunc("/dashboard/{site}/countries", reporting.Countries)
+	mux.HandleFunc("/dashboard/{site}/mail/{id}/resend", reporting.ResendMail)
+	mux.Handle("/admin/subject", access.RequireAll(http.HandlerFunc(admin.SubjectExport)))
+	mux.Handle("/admin/subject/erase", access.RequireAll(http.HandlerFunc(admin.SubjectErase)))
+	mux.Handle("/admin/health", access.RequireAll(http.HandlerFunc(HealthReport)))
+}
+
+// Returns mux wrapped to identify callers as required by the admin config: by
+// tailnet identity, or as one of the local Admin.Users.
+func adminHandler(admin config.AdminConfig, mux http.Handler) http.Handler {
+	if admin.Mode == config.ADMIN_LOCAL {
+		return access.Authenticate(mux)
+	}
+	return access.Middleware(tailscale.LC, mux)
+}
+
+// Listens on the local admin address, replacing any stale unix socket.
+func listenAdmin(admin config.AdminConfig) (net.Listener, error) {
+	network, addr := admin.Network()
+	if network == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, addr)
 }
 
 func envName() string {
@@ -266,21 +401,59 @@ func envName() string {
 }
 
 func main() {
-	var err error
-	conf, err = config.LoadConfig(os.Getenv("CONFIG_FILE"))
+	configFile := os.Getenv("CONFIG_FILE")
+	if len(os.Args) > 1 {
+		if err := runCommand(configFile, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+	conf, err := config.LoadConfig(configFile)
 	if err != nil {
 		log.Fatalf("could not load config: %v", err)
 	}
-	if err := db.Init(conf); err != nil {
-		log.Printf("No DB available, will continue with Prometheus exports only!: %v", err)
+	config.Set(conf)
+	// Cancelled by the first SIGTERM or interrupt, after which a second one
+	// stops us immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+
+	if err := spool.Init(filepath.Join(conf.StateDirectory, "spool"), conf.SpoolLimit()); err != nil {
+		log.Printf("Could not open spool, storing events directly in the DB: %v", err)
+	}
+	dbErr := db.Init(conf)
+	if dbErr != nil {
+		log.Printf("No DB available, spooling events until it is: %v", dbErr)
+	}
+	runBackground(bgCtx, func(ctx context.Context) {
+		if dbErr != nil {
+			connectDB(ctx, conf)
+		}
+		runBackground(ctx, processMailQueue)
+		consumeSpool(ctx)
+	})
+	if err := geoip.Init(conf); err != nil {
+		log.Printf("GeoIP lookups disabled: %v", err)
 	}
-	reporting.SetConfig(conf)
+	runBackground(bgCtx, func(ctx context.Context) {
+		watchConfig(ctx, configFile, 10*time.Second)
+	})
 
-	err = tailscale.Init(fmt.Sprintf("metrics-%s", envName()), conf.StateDirectory, 30*time.Second)
-	if err != nil {
-		log.Fatalf("Failed to connect to tailscale: %v", err)
+	var adminListener net.Listener
+	if conf.Admin.Mode == config.ADMIN_LOCAL {
+		if adminListener, err = listenAdmin(conf.Admin); err != nil {
+			log.Fatalf("Failed to listen for admin requests: %v", err)
+		}
+	} else {
+		err = tailscale.Init(fmt.Sprintf("metrics-%s", envName()), conf.StateDirectory, 30*time.Second)
+		if err != nil {
+			log.Fatalf("Failed to connect to tailscale: %v", err)
+		}
 	}
 
+	registerHealthChecks(conf)
+	runBackground(bgCtx, health.Monitor)
 	setupPublicHandlers(http.DefaultServeMux)
 	tsmux := http.NewServeMux()
 	setupTSHandlers(tsmux)
@@ -290,20 +463,35 @@ func main() {
 		port = "8080"
 	}
 	// Always listen on localhost
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		log.Println("listening on", port)
-		http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
-		wg.Done()
-	}()
+	servers := new(sync.WaitGroup)
+	public := &http.Server{Addr: fmt.Sprintf(":%s", port)}
+	log.Println("listening on", port)
+	startServer(servers, "public", public.ListenAndServe)
+
+	// And serve the admin surface on TS, or the local admin listener
+	adminSrv := &http.Server{Handler: adminHandler(conf.Admin, tsmux)}
+	if adminListener != nil {
+		log.Println("admin listening on", conf.Admin.Listen)
+		startServer(servers, "admin", func() error { return adminSrv.Serve(adminListener) })
+	} else {
+		startServer(servers, "tailscale", func() error { return tailscale.Serve(adminSrv) })
+	}
+	ready.Store(true)
 
-	// Try and also listen on TS (for /metrics)
-	wg.Add(1)
+	stopped := make(chan struct{})
 	go func() {
-		tailscale.Serve(tsmux)
-		wg.Done()
+		servers.Wait()
+		close(stopped)
 	}()
-
-	wg.Wait()
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+		log.Printf("All servers stopped")
+	}
+	stop()
+	if err := shutdown(stopBackground, public, adminSrv); err != nil {
+		log.Printf("Shutdown was not clean: %v", err)
+	}
+	closeResources()
+	log.Printf("Shutdown complete")
 }
@@ -2,18 +2,41 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	smtpmock "github.com/mocktools/go-smtp-mock/v2"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
 
+	"mattb.nz/web/metrics/access"
 	"mattb.nz/web/metrics/config"
 	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/geoip"
+	"mattb.nz/web/metrics/health"
 	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/reporting"
+	"mattb.nz/web/metrics/spam"
+	"mattb.nz/web/metrics/spool"
 )
 
 func Test_CollectMetric(t *testing.T) {
@@ -24,7 +47,7 @@ func Test_CollectMetric(t *testing.T) {
 	if err := db.Init(tconf); err != nil {
 		panic(err)
 	}
-	conf = tconf
+	config.Set(tconf)
 
 	tests := []struct {
 		method string
@@ -66,15 +89,15 @@ func Test_CollectMetric(t *testing.T) {
 		}
 	}
 
-	sites := metrics.Sites
-	if sites["test.com"].EventCount["pageview"] != 2 {
-		t.Error("Expected 2 pageviews, got", sites["test.com"].EventCount["pageview"])
+	sites := metrics.Sites()
+	if sites["test.com"].Counts().EventCount["pageview"] != 2 {
+		t.Error("Expected 2 pageviews, got", sites["test.com"].Counts().EventCount["pageview"])
 	}
-	if sites["test.com"].EventCount["click"] != 1 {
-		t.Error("Expected 1 click, got", sites["test.com"].EventCount["click"])
+	if sites["test.com"].Counts().EventCount["click"] != 1 {
+		t.Error("Expected 1 click, got", sites["test.com"].Counts().EventCount["click"])
 	}
-	if sites["test.com"].EventCount["activity"] != 1 {
-		t.Error("Expected 1 activity, got", sites["test.com"].EventCount["activity"])
+	if sites["test.com"].Counts().EventCount["activity"] != 1 {
+		t.Error("Expected 1 activity, got", sites["test.com"].Counts().EventCount["activity"])
 	}
 
 	req, err := http.NewRequest("GET", "/metrics", nil)
@@ -98,15 +121,31 @@ func Test_CollectMetric(t *testing.T) {
 	if !strings.Contains(rr.Body.String(), "events_total{event=\"activity\",site=\"test.com\"} 1") {
 		t.Error("Expected 1 activity, got", rr.Body.String())
 	}
+	if !strings.Contains(rr.Body.String(), "visitors_today{site=\"test.com\"} 3") {
+		t.Error("Expected 3 visitors, got", rr.Body.String())
+	}
+
+	// And on the dashboard.
+	req, err = http.NewRequest("GET", "/dashboard/test.com", nil)
+	if err != nil {
+		t.Fatal("Error creating request:", err)
+	}
+	rr = httptest.NewRecorder()
+	tsmux.ServeHTTP(rr, req)
+	for _, want := range []string{"<div>pageview</div>\n  <div>2</div>", "<div>visitors today</div>\n  <div>3</div>"} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Expected dashboard to include %q, got %s", want, rr.Body.String())
+		}
+	}
 
 	var c int64
-	if err := db.DB.Model(&db.EventLog{}).Count(&c).Error; err != nil {
+	if err := db.Current().Model(&db.EventLog{}).Count(&c).Error; err != nil {
 		t.Error("Error counting events:", err)
 	}
 	if c != 4 {
 		t.Error("Expected 4 events, got", c)
 	}
-	if err := db.DB.Model(&db.UserAgent{}).Count(&c).Error; err != nil {
+	if err := db.Current().Model(&db.UserAgent{}).Count(&c).Error; err != nil {
 		t.Error("Error counting user agents:", err)
 	}
 	if c != 3 {
@@ -123,7 +162,7 @@ func Test_CollectMetric_NoDB(t *testing.T) {
 	if err := db.Init(tconf); err != nil {
 		panic(err)
 	}
-	conf = tconf
+	config.Set(tconf)
 
 	mux := http.NewServeMux()
 	setupPublicHandlers(mux)
@@ -145,15 +184,6 @@ func Test_CollectMetric_NoDB(t *testing.T) {
 
 // Test contact submission functionality
 func Test_ContactForm(t *testing.T) {
-	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
-	if err != nil {
-		panic(err)
-	}
-	if err := db.Init(tconf); err != nil {
-		panic(err)
-	}
-	conf = tconf
-
 	server := smtpmock.New(smtpmock.ConfigurationAttr{
 		LogToStdout:       true,
 		LogServerActivity: true,
@@ -161,20 +191,24 @@ func Test_ContactForm(t *testing.T) {
 	if err := server.Start(); err != nil {
 		panic(err)
 	}
-	old_host := os.Getenv("SMTP_HOST")
-	old_port := os.Getenv("SMTP_PORT")
-	old_user := os.Getenv("SMTP_USER")
 	defer func() {
-		os.Setenv("SMTP_HOST", old_host)
-		os.Setenv("SMTP_PORT", old_port)
-		os.Setenv("SMTP_PORT", old_user)
 		if err := server.Stop(); err != nil {
 			panic(err)
 		}
 	}()
-	os.Setenv("SMTP_HOST", "127.0.0.1")
-	os.Setenv("SMTP_PORT", fmt.Sprintf("%d", server.PortNumber()))
-	os.Setenv("SMTP_USER", "")
+	// No Mail section in the config, so the legacy environment variables apply.
+	t.Setenv("SMTP_HOST", "127.0.0.1")
+	t.Setenv("SMTP_PORT", fmt.Sprintf("%d", server.PortNumber()))
+	t.Setenv("SMTP_USER", "")
+
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
 
 	tests := []struct {
 		method string
@@ -213,7 +247,13 @@ func Test_ContactForm(t *testing.T) {
 		}
 	}
 
-	// Should only have 1 message generated
+	// Should only have 1 message generated, sent from the queue.
+	if sent := sendDueMail(); sent != 1 {
+		t.Errorf("Expected 1 queued email to be sent, sent %d", sent)
+	}
+	if n := len(server.Messages()); n != 1 {
+		t.Errorf("Expected 1 email to be sent, got %d", n)
+	}
 	for i, msg := range server.Messages() {
 		if !msg.IsConsistent() {
 			t.Errorf("Email %d did not send successfully!", i+1)
@@ -222,13 +262,21 @@ func Test_ContactForm(t *testing.T) {
 		if i != 0 {
 			t.Errorf("Expected 1 email to be generated, but found messaged #%d: %s", i+1, msgData)
 		}
-		expect := "Contact form submission from test.com"
-		if !strings.Contains(msgData, expect) {
-			t.Errorf("Message %d did not contain '%s': %s", i+1, expect, msgData)
+		for _, expect := range []string{
+			"Subject: Contact form submission from test.com",
+			"From: <web-contact@mkmba.nz>",
+			"Reply-To: \"me\" <a@b.com>",
+			"Message-ID: <",
+			"Content-Type: multipart/alternative",
+			"Content-Type: text/html",
+		} {
+			if !strings.Contains(msgData, expect) {
+				t.Errorf("Message %d did not contain '%s': %s", i+1, expect, msgData)
+			}
 		}
 	}
 	var msgs []db.MailLog
-	if err := db.DB.Model(&db.MailLog{}).Find(&msgs).Error; err != nil {
+	if err := db.Current().Model(&db.MailLog{}).Find(&msgs).Error; err != nil {
 		panic(err)
 	}
 	if len(msgs) != 1 {
@@ -254,3 +302,1438 @@ func Test_ContactForm(t *testing.T) {
 	}
 
 }
+
+// Test campaign parameters are extracted and reported.
+func Test_Campaigns(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+
+	for _, body := range []string{
+		`{"event":"pageview","sessionid":"camp1","page":"http://test.com/p?id=1&utm_source=news&utm_medium=email&utm_campaign=launch"}`,
+		`{"event":"pageview","sessionid":"camp2","page":"http://test.com/?utm_source=news&utm_medium=email&utm_campaign=launch"}`,
+		`{"event":"click","sessionid":"camp2","target":"signup"}`,
+		`{"event":"pageview","sessionid":"camp3","page":"http://test.com/?utm_source=%3Cscript%3Ealert(1)%3C/script%3E&utm_medium=email&utm_campaign=launch"}`,
+	} {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Origin", "http://test.com")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	e := db.EventLog{}
+	if err := db.Current().Where("json_extract(raw_event, '$.SessionId') = ?", "camp1").First(&e).Error; err != nil {
+		t.Fatalf("Could not find campaign event: %v", err)
+	}
+	if e.Page != "http://test.com/p?id=1" {
+		t.Errorf("Expected utm parameters to be stripped from page, got %s", e.Page)
+	}
+	if e.UtmSource != "news" || e.UtmMedium != "email" || e.UtmCampaign != "launch" {
+		t.Errorf("Expected news/email/launch campaign, got %s/%s/%s", e.UtmSource, e.UtmMedium, e.UtmCampaign)
+	}
+	if e.SessionID != "camp1" {
+		t.Errorf("Expected session to be stored, got %q", e.SessionID)
+	}
+	// Events in the session from before the report's period aren't counted.
+	if err := db.StoreEvent(db.PendingEvent{EventLog: db.EventLog{
+		When:     time.Now().AddDate(0, 0, -10),
+		Host:     "test.com",
+		RawEvent: metrics.JsonEvent{Event: metrics.EV_PAGEVIEW, SessionId: "camp1"},
+	}}); err != nil {
+		t.Fatalf("Could not store old event: %v", err)
+	}
+
+	rmux := http.NewServeMux()
+	rmux.HandleFunc("/dashboard/{site}/campaigns", reporting.Campaigns)
+	req, err := http.NewRequest("GET", "/dashboard/test.com/campaigns?days=1", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	rmux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v", rr.Code)
+	}
+	expect := "<div>news</div>\n  <div>email</div>\n  <div>launch</div>\n  <div>2</div>\n  <div>2</div>\n  <div>1</div>"
+	if !strings.Contains(rr.Body.String(), expect) {
+		t.Errorf("Expected campaign report to contain %q, got %s", expect, rr.Body.String())
+	}
+	// Campaign parameters are attacker controlled.
+	if strings.Contains(rr.Body.String(), "<script>") || !strings.Contains(rr.Body.String(), "<div>&lt;script&gt;alert(1)&lt;/script&gt;</div>") {
+		t.Errorf("Expected utm_source to be escaped, got %s", rr.Body.String())
+	}
+}
+
+// Test referers are grouped by source and domain in the referers report.
+func Test_Referers(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	for _, referer := range []string{
+		"https://www.duckduckgo.com/",
+		"https://duckduckgo.com/?q=metrics",
+		"https://lobste.rs/s/abc",
+		"https://evil.example/<script>alert(1)</script>",
+		"<script>alert(3)</script>",
+	} {
+		body := fmt.Sprintf(`{"event":"pageview","page":"http://test.com/","referer":%q}`, referer)
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Origin", "http://test.com")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	rmux := http.NewServeMux()
+	rmux.HandleFunc("/dashboard/{site}/referers", reporting.Referers)
+	rmux.HandleFunc("/dashboard/{site}", reporting.Site)
+	for _, test := range []struct {
+		path   string
+		expect string
+	}{
+		{"/dashboard/test.com/referers", "<div>search</div>\n  <div>DuckDuckGo</div>\n  <div>2</div>"},
+		{"/dashboard/test.com/referers", "domain=lobste.rs\">lobste.rs</a></div>\n  <div>social</div>"},
+		{"/dashboard/test.com/referers?domain=duckduckgo.com", "<div>https://duckduckgo.com/?q=metrics</div>\n  <div>1</div>"},
+		// Referers and the domain parameter are attacker controlled.
+		{"/dashboard/test.com/referers?domain=evil.example", "<div>https://evil.example/&lt;script&gt;alert(1)&lt;/script&gt;</div>"},
+		{"/dashboard/test.com/referers?domain=%3Cscript%3Ealert(2)%3C/script%3E", "<h2>Referring URLs from &lt;script&gt;alert(2)&lt;/script&gt;</h2>"},
+		// Referers which don't parse are grouped, rather than shown as domains.
+		{"/dashboard/test.com/referers?domain=(invalid)", "<div>&lt;script&gt;alert(3)&lt;/script&gt;</div>"},
+		{"/dashboard/test.com", "<div>(invalid)</div>"},
+	} {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		rmux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v", test.path, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), test.expect) {
+			t.Errorf("%s: expected report to contain %q, got %s", test.path, test.expect, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "<script>") {
+			t.Errorf("%s: expected script to be escaped, got %s", test.path, rr.Body.String())
+		}
+	}
+}
+
+// Test the per-site handling of DNT/GPC privacy signals.
+func Test_PrivacySignals(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	sitedata := metrics.GetSiteData("test.com")
+
+	tests := []struct {
+		policy     config.PrivacyPolicy
+		header     string
+		counted    uint
+		suppressed uint
+		stored     int64
+	}{
+		{config.PRIVACY_IGNORE, "DNT", 1, 0, 1},
+		{config.PRIVACY_DROP, "", 1, 0, 1}, // No signal, so recorded.
+		{config.PRIVACY_DROP, "DNT", 0, 1, 0},
+		{config.PRIVACY_COUNT, "Sec-GPC", 1, 1, 0},
+		{config.PRIVACY_ANONYMISE, "Sec-GPC", 1, 1, 1},
+	}
+	for i, test := range tests {
+		tconf.Sites[0].PrivacySignals = test.policy
+		config.Set(tconf)
+		counted := sitedata.Counts().EventCount[metrics.EV_CONTEXT]
+		suppressed := sitedata.Counts().Suppressed[metrics.EV_CONTEXT]
+		stored, _ := db.Count(&db.EventLog{}, "json_extract(raw_event, '$.Event') = ?", metrics.EV_CONTEXT)
+
+		req, err := http.NewRequest("POST", "/", strings.NewReader(`{"event":"context","sessionid":"dnt"}`))
+		if err != nil {
+			t.Fatalf("Test %d: Error creating request: %v", i, err)
+		}
+		req.Header.Set("Origin", "http://test.com")
+		req.RemoteAddr = "10.1.2.3:4567"
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Test %d: handler returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+
+		if got := sitedata.Counts().EventCount[metrics.EV_CONTEXT] - counted; got != test.counted {
+			t.Errorf("Test %d: expected %d events counted, got %d", i, test.counted, got)
+		}
+		if got := sitedata.Counts().Suppressed[metrics.EV_CONTEXT] - suppressed; got != test.suppressed {
+			t.Errorf("Test %d: expected %d events suppressed, got %d", i, test.suppressed, got)
+		}
+		now, _ := db.Count(&db.EventLog{}, "json_extract(raw_event, '$.Event') = ?", metrics.EV_CONTEXT)
+		if now-stored != test.stored {
+			t.Errorf("Test %d: expected %d events stored, got %d", i, test.stored, now-stored)
+		}
+	}
+
+	e := db.EventLog{}
+	if err := db.Current().Where("json_extract(raw_event, '$.Event') = ?", metrics.EV_CONTEXT).Last(&e).Error; err != nil {
+		t.Fatal("Could not find anonymised event:", err)
+	}
+	if e.IP != "" || e.VisitorID != "" || e.UserAgentID != 0 || e.RawEvent.SessionId != "" {
+		t.Errorf("Expected anonymised event, got %+v", e)
+	}
+}
+
+// Test events matching a site's ignore lists are counted by reason, not stored.
+func Test_IgnoredEvents(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Sites[1].IgnoreNets = []string{"172.16.0.0/12"}
+	tconf.Sites[1].IgnorePaths = []string{"/admin/*"}
+	tconf.Sites[1].IgnoreUserAgents = []string{"*HeadlessChrome*"}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	sitedata := metrics.GetSiteData("another.com")
+
+	tests := []struct {
+		ip     string
+		page   string
+		ua     string
+		reason config.IgnoreReason
+	}{
+		{"10.1.2.3", "http://test2.com/", "Firefox", config.IGNORE_NONE},
+		{"10.10.11.3", "http://test2.com/", "Firefox", config.IGNORE_NET},
+		{"172.16.2.3", "http://test2.com/", "Firefox", config.IGNORE_NET},
+		{"10.1.2.3", "http://test2.com/admin/posts", "Firefox", config.IGNORE_PATH},
+		{"10.1.2.3", "http://test2.com/", "Mozilla/5.0 HeadlessChrome/120.0", config.IGNORE_USER_AGENT},
+	}
+	for i, test := range tests {
+		ignored := sitedata.Counts().Ignored[string(test.reason)]
+		stored, _ := db.Count(&db.EventLog{}, "host = ?", "another.com")
+
+		body := fmt.Sprintf(`{"event":"pageview","page":%q}`, test.page)
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Test %d: Error creating request: %v", i, err)
+		}
+		req.Header.Set("Origin", "http://test2.com")
+		req.Header.Set("User-Agent", test.ua)
+		req.RemoteAddr = test.ip + ":4567"
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Test %d: handler returned wrong status code: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+
+		now, _ := db.Count(&db.EventLog{}, "host = ?", "another.com")
+		if test.reason == config.IGNORE_NONE {
+			if now-stored != 1 {
+				t.Errorf("Test %d: expected event to be stored", i)
+			}
+			continue
+		}
+		if now != stored {
+			t.Errorf("Test %d: expected %s event not to be stored", i, test.reason)
+		}
+		if got := sitedata.Counts().Ignored[string(test.reason)] - ignored; got != 1 {
+			t.Errorf("Test %d: expected 1 event ignored by %s, got %d", i, test.reason, got)
+		}
+	}
+}
+
+// Test pageviews and vitals are broken down by parsed User-Agent.
+func Test_Devices(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	ua := "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36 Devices/1"
+	for _, body := range []string{
+		`{"event":"pageview","loadtime":100}`,
+		`{"event":"pageview","loadtime":300}`,
+		`{"event":"vitals","lcp":1500}`,
+	} {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Origin", "http://test2.com")
+		req.Header.Set("User-Agent", ua)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	rmux := http.NewServeMux()
+	rmux.HandleFunc("/dashboard/{site}/devices", reporting.Devices)
+	req, err := http.NewRequest("GET", "/dashboard/another.com/devices", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	rmux.ServeHTTP(rr, req)
+	for _, expect := range []string{
+		"<div>Chrome</div>\n  <div>2</div>\n  <div>200 ms</div>\n  <div>1500 ms</div>",
+		"<div>Android</div>\n  <div>2</div>",
+		"<div>mobile</div>\n  <div>2</div>",
+	} {
+		if !strings.Contains(rr.Body.String(), expect) {
+			t.Errorf("Expected devices report to contain %q, got %s", expect, rr.Body.String())
+		}
+	}
+
+	// Sites which aren't configured aren't reported, or echoed.
+	req = httptest.NewRequest("GET", "/dashboard/%3Cimg%20src=x%20onerror=alert(1)%3E/devices", nil)
+	rr = httptest.NewRecorder()
+	rmux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound || strings.Contains(rr.Body.String(), "<img") {
+		t.Errorf("Expected %d for an unknown site, got %d: %s", http.StatusNotFound, rr.Code, rr.Body.String())
+	}
+}
+
+// Test events are geolocated and reported by country.
+func Test_Countries(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.GeoIPDatabase = "geoip/testdata/test-city.mmdb"
+	if err := geoip.Init(tconf); err != nil {
+		panic(err)
+	}
+	defer geoip.Close()
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	for _, ip := range []string{"81.2.69.1", "81.2.69.2", "202.36.1.1"} {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(`{"event":"pageview","sessionid":"geo"}`))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Origin", "http://test.com")
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v. Body: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+	}
+
+	e := db.EventLog{}
+	if err := db.Current().Where("ip = ?", "202.36.1.1").First(&e).Error; err != nil {
+		t.Fatal("Could not find geolocated event:", err)
+	}
+	if e.Country != "NZ" || e.Region != "Wellington Region" || e.City != "Wellington" {
+		t.Errorf("Expected event located in Wellington, NZ, got %s/%s/%s", e.Country, e.Region, e.City)
+	}
+	if metrics.GetSiteData("test.com").Counts().CountryEventCount["GB"][metrics.EV_PAGEVIEW] != 2 {
+		t.Error("Expected 2 pageviews from GB, got", metrics.GetSiteData("test.com").Counts().CountryEventCount["GB"])
+	}
+
+	rmux := http.NewServeMux()
+	rmux.HandleFunc("/dashboard/{site}/countries", reporting.Countries)
+	req, err := http.NewRequest("GET", "/dashboard/test.com/countries", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	rmux.ServeHTTP(rr, req)
+	expect := "<div>GB</div>\n  <div>2</div>\n  <div>2</div>"
+	if !strings.Contains(rr.Body.String(), expect) {
+		t.Errorf("Expected countries report to contain %q, got %s", expect, rr.Body.String())
+	}
+
+	// Sites which aren't configured aren't reported, or echoed.
+	req = httptest.NewRequest("GET", "/dashboard/%3Cimg%20src=x%20onerror=alert(1)%3E/countries", nil)
+	rr = httptest.NewRecorder()
+	rmux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound || strings.Contains(rr.Body.String(), "<img") {
+		t.Errorf("Expected %d for an unknown site, got %d: %s", http.StatusNotFound, rr.Code, rr.Body.String())
+	}
+}
+
+// Test valid configs are swapped in on reload, and invalid ones rejected.
+func Test_ReloadConfig(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	filename := t.TempDir() + "/config.json"
+	write := func(data string) {
+		if err := os.WriteFile(filename, []byte(data), 0o600); err != nil {
+			t.Fatal("Could not write config:", err)
+		}
+	}
+
+	write(`{"Sites": [{"Host": "new.com", "AllowedOrigins": ["http://new.com"]}]}`)
+	reloads := metrics.ConfigReloads.Load()
+	if err := reloadConfig(filename); err != nil {
+		t.Fatal("Expected no error, got", err)
+	}
+	if metrics.ConfigReloads.Load() != reloads+1 {
+		t.Error("Expected reload to be counted")
+	}
+	if site, _ := config.Current().GetHostForOrigin("http://new.com"); site.Host != "new.com" {
+		t.Error("Expected new.com to be served after reload, got", site.Host)
+	}
+	if site, _ := config.Current().GetHostForOrigin("http://test.com"); site.Host != "" {
+		t.Error("Expected test.com to be removed after reload, got", site.Host)
+	}
+
+	write(`{"Sites": [], "IgnoreNets": ["not-a-cidr"]}`)
+	failures := metrics.ConfigReloadFailures.Load()
+	if err := reloadConfig(filename); err == nil {
+		t.Error("Expected error reloading invalid config, got nil")
+	}
+	if metrics.ConfigReloadFailures.Load() != failures+1 {
+		t.Error("Expected reload failure to be counted")
+	}
+	if site, _ := config.Current().GetHostForOrigin("http://new.com"); site.Host != "new.com" {
+		t.Error("Expected previous config to be kept after failed reload, got", site.Host)
+	}
+}
+
+// Fake WhoIs provider, mapping remote addresses to tailnet identities.
+type fakeWhoIs map[string]*apitype.WhoIsResponse
+
+func (f fakeWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if who, ok := f[remoteAddr]; ok {
+		return who, nil
+	}
+	return nil, errors.New("no such peer")
+}
+
+// Test dashboards are only shown to the tailnet identities allowed to see them.
+func Test_AccessControl(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Groups = map[string][]string{"group:test": {"bob@example.com"}}
+	tconf.Access = []config.AccessRule{
+		{Who: []string{"alice@example.com", "tag:monitoring"}, Sites: []string{"*"}},
+		{Who: []string{"group:test"}, Sites: []string{"test.com"}},
+	}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	user := func(login string) *apitype.WhoIsResponse {
+		return &apitype.WhoIsResponse{Node: &tailcfg.Node{}, UserProfile: &tailcfg.UserProfile{LoginName: login}}
+	}
+	whois := fakeWhoIs{
+		"100.64.0.1:1234": user("alice@example.com"),
+		"100.64.0.2:1234": user("bob@example.com"),
+		"100.64.0.3:1234": user("eve@example.com"),
+		"100.64.0.4:1234": {
+			Node:        &tailcfg.Node{Tags: []string{"tag:monitoring"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dashboard", reporting.Home)
+	mux.HandleFunc("/dashboard/{site}", reporting.Site)
+	mux.HandleFunc("/dashboard/{site}/countries", reporting.Countries)
+	mux.Handle("/metrics", access.RequireAll(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	handler := access.Middleware(whois, mux)
+
+	tests := []struct {
+		remoteAddr string
+		path       string
+		code       int
+		contains   []string
+		excludes   []string
+	}{
+		{"100.64.0.1:1234", "/dashboard", http.StatusOK, []string{"test.com", "another.com"}, nil},
+		{"100.64.0.2:1234", "/dashboard", http.StatusOK, []string{"test.com"}, []string{"another.com"}},
+		{"100.64.0.3:1234", "/dashboard", http.StatusOK, nil, []string{"test.com", "another.com"}},
+		{"100.64.0.1:1234", "/dashboard/another.com", http.StatusOK, nil, nil},
+		{"100.64.0.2:1234", "/dashboard/test.com", http.StatusOK, nil, nil},
+		{"100.64.0.2:1234", "/dashboard/test.com/countries", http.StatusOK, nil, nil},
+		{"100.64.0.2:1234", "/dashboard/another.com", http.StatusForbidden, nil, nil},
+		{"100.64.0.2:1234", "/dashboard/another.com/countries", http.StatusForbidden, nil, nil},
+		{"100.64.0.3:1234", "/dashboard/test.com", http.StatusForbidden, nil, nil},
+		{"100.64.0.9:1234", "/dashboard/test.com", http.StatusForbidden, nil, nil}, // WhoIs fails
+		{"100.64.0.4:1234", "/metrics", http.StatusOK, nil, nil},
+		{"100.64.0.2:1234", "/metrics", http.StatusForbidden, nil, nil},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Error creating request: %v", i, err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("Test %d: %s from %s: expected status %d, got %d", i, test.path, test.remoteAddr, test.code, rr.Code)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(rr.Body.String(), s) {
+				t.Errorf("Test %d: expected %s to contain %s, got %s", i, test.path, s, rr.Body.String())
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(rr.Body.String(), s) {
+				t.Errorf("Test %d: expected %s not to contain %s, got %s", i, test.path, s, rr.Body.String())
+			}
+		}
+	}
+}
+
+// Test the admin surface end to end on a local listener, without Tailscale.
+func Test_AdminListener(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	tconf.Admin = config.AdminConfig{
+		Mode:   config.ADMIN_LOCAL,
+		Listen: "unix:" + socket,
+		Users: []config.AdminUser{
+			{Name: "ops", Token: "ops-token"},
+			{Name: "viewer", Password: "hunter2"},
+		},
+	}
+	tconf.Access = []config.AccessRule{
+		{Who: []string{"ops"}, Sites: []string{"*"}},
+		{Who: []string{"viewer"}, Sites: []string{"test.com"}},
+	}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupTSHandlers(mux)
+	ln, err := listenAdmin(tconf.Admin)
+	if err != nil {
+		t.Fatal("Could not listen:", err)
+	}
+	server := &http.Server{Handler: adminHandler(tconf.Admin, mux)}
+	go server.Serve(ln)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	tests := []struct {
+		path     string
+		token    string
+		user     string
+		password string
+		code     int
+	}{
+		{"/dashboard", "", "", "", http.StatusUnauthorized},
+		{"/dashboard", "wrong", "", "", http.StatusUnauthorized},
+		{"/dashboard", "", "viewer", "wrong", http.StatusUnauthorized},
+		{"/dashboard", "", "ops", "", http.StatusUnauthorized}, // ops has no password
+		{"/dashboard", "ops-token", "", "", http.StatusOK},
+		{"/dashboard/another.com", "ops-token", "", "", http.StatusOK},
+		{"/metrics", "ops-token", "", "", http.StatusOK},
+		{"/admin/subject?email=nobody@test.com", "ops-token", "", "", http.StatusOK},
+		{"/dashboard/test.com", "", "viewer", "hunter2", http.StatusOK},
+		{"/dashboard/another.com", "", "viewer", "hunter2", http.StatusForbidden},
+		{"/metrics", "", "viewer", "hunter2", http.StatusForbidden},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", "http://admin"+test.path, nil)
+		if err != nil {
+			t.Fatalf("Test %d: Error creating request: %v", i, err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		} else if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Test %d: %s failed: %v", i, test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("Test %d: %s: expected status %d, got %d", i, test.path, test.code, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("Test %d: expected WWW-Authenticate header on 401", i)
+		}
+	}
+
+	// Erasure requires JSON, so can't be submitted by another site's form,
+	// and records who requested it.
+	for i, test := range []struct {
+		contentType string
+		body        string
+		code        int
+	}{
+		{"application/x-www-form-urlencoded", "email=nobody@test.com", http.StatusUnsupportedMediaType},
+		{"text/plain", `{"Email": "nobody@test.com"}`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"Action": "redact"}`, http.StatusBadRequest},
+		{"application/json; charset=utf-8", `{"Email": "nobody@test.com", "Action": "redact", "Reason": "test"}`, http.StatusOK},
+	} {
+		req, err := http.NewRequest("POST", "http://admin/admin/subject/erase", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Erase %d: Error creating request: %v", i, err)
+		}
+		req.Header.Set("Authorization", "Bearer ops-token")
+		req.Header.Set("Content-Type", test.contentType)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Erase %d: failed: %v", i, err)
+		}
+		var erasure db.Erasure
+		json.NewDecoder(resp.Body).Decode(&erasure)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("Erase %d: expected status %d, got %d", i, test.code, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && (erasure.RequestedBy != "ops" || erasure.Action != db.ERASE_REDACT || erasure.Reason != "test") {
+			t.Errorf("Erase %d: expected redaction requested by ops, got %+v", i, erasure)
+		}
+	}
+}
+
+// Test shutdown flips /readyz, then waits for in-flight requests and
+// background work before returning.
+func Test_Shutdown(t *testing.T) {
+	oldDelay, oldTimeout := drainDelay, shutdownTimeout
+	drainDelay, shutdownTimeout = 100*time.Millisecond, 5*time.Second
+	defer func() {
+		drainDelay, shutdownTimeout = oldDelay, oldTimeout
+	}()
+
+	started := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", Readyz)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Could not listen:", err)
+	}
+	srv := &http.Server{Handler: mux}
+	servers := new(sync.WaitGroup)
+	startServer(servers, "test", func() error { return srv.Serve(ln) })
+	url := "http://" + ln.Addr().String()
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	var backgroundDone atomic.Bool
+	runBackground(bgCtx, func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond) // e.g. flushing pending writes
+		backgroundDone.Store(true)
+	})
+	ready.Store(true)
+	if resp, err := http.Get(url + "/readyz"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected ready before shutdown, got %v, %v", resp, err)
+	}
+
+	slow := make(chan string)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slow <- string(body)
+	}()
+	<-started
+
+	result := make(chan error)
+	go func() {
+		result <- shutdown(stopBackground, srv)
+	}()
+	for ready.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	// Still serving while draining, but not ready.
+	if resp, err := http.Get(url + "/readyz"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while draining, got %v, %v", resp, err)
+	}
+
+	if err := <-result; err != nil {
+		t.Error("Expected clean shutdown, got", err)
+	}
+	if body := <-slow; body != "done" {
+		t.Errorf("Expected in-flight request to complete, got %q", body)
+	}
+	if !backgroundDone.Load() {
+		t.Error("Expected shutdown to wait for background work")
+	}
+	servers.Wait()
+	if _, err := http.Get(url + "/readyz"); err == nil {
+		t.Error("Expected server to have stopped")
+	}
+}
+
+// Test /healthz and /readyz report the overall status, and /admin/health the
+// status of each component.
+func Test_HealthChecks(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+	if err := spool.Init(t.TempDir(), tconf.SpoolLimit()); err != nil {
+		t.Fatal("Could not open spool:", err)
+	}
+	defer spool.Close()
+	registerHealthChecks(tconf)
+	health.Refresh(context.Background())
+	ready.Store(true)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	setupTSHandlers(mux)
+	get := func(path string) (int, health.Report) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		var report health.Report
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s: could not decode %s: %v", path, rr.Body.String(), err)
+		}
+		if path != "/admin/health" && report.Components != nil {
+			t.Errorf("%s: expected only the status, got %s", path, rr.Body.String())
+		}
+		return rr.Code, report
+	}
+
+	// Tailscale isn't connected in tests, but that isn't critical.
+	code, report := get("/readyz")
+	if code != http.StatusOK || report.Status != health.STATUS_DEGRADED {
+		t.Errorf("Expected ready but degraded, got %d %+v", code, report)
+	}
+	want := map[string]string{
+		"database":  health.STATUS_OK,
+		"spool":     health.STATUS_OK,
+		"tailscale": health.STATUS_FAIL,
+		"smtp":      health.STATUS_DISABLED,
+	}
+	_, report = get("/admin/health")
+	for name, status := range want {
+		if report.Components[name].Status != status {
+			t.Errorf("Expected %s to be %s, got %+v", name, status, report.Components[name])
+		}
+	}
+
+	// Along with any backlog.
+	if err := spool.Append(map[string]string{"event": "pageview"}); err != nil {
+		t.Fatal("Could not spool event:", err)
+	}
+	health.Refresh(context.Background())
+	_, report = get("/admin/health")
+	if details := report.Components["spool"].Details; details["pending"] != 1.0 || details["oldest_seconds"] == nil {
+		t.Errorf("Expected 1 event pending in the spool, got %+v", report.Components["spool"])
+	}
+	if details := report.Components["mailqueue"].Details; details["pending"] == nil || details["dead"] == nil {
+		t.Errorf("Expected mail queue backlog, got %+v", report.Components["mailqueue"])
+	}
+
+	// Results are cached until the next refresh.
+	server := smtpmock.New(smtpmock.ConfigurationAttr{})
+	if err := server.Start(); err != nil {
+		panic(err)
+	}
+	defer server.Stop()
+	tconf.Mail = config.MailConfig{Host: "127.0.0.1", Port: fmt.Sprintf("%d", server.PortNumber())}
+	config.Set(tconf)
+	if _, report := get("/admin/health"); report.Components["smtp"].Status != health.STATUS_DISABLED {
+		t.Error("Expected cached smtp status, got", report.Components["smtp"])
+	}
+	health.Refresh(context.Background())
+	if _, report := get("/admin/health"); report.Components["smtp"].Status != health.STATUS_OK {
+		t.Error("Expected smtp to be ok, got", report.Components["smtp"])
+	}
+
+	// Without the database we're degraded (spooling events), but still ready.
+	saved := db.Current()
+	db.Set(nil)
+	health.Refresh(context.Background())
+	code, report = get("/readyz")
+	if code != http.StatusOK || report.Status != health.STATUS_DEGRADED {
+		t.Errorf("Expected ready but degraded, got %d %+v", code, report)
+	}
+	if _, report = get("/admin/health"); report.Components["database"].Error == "" {
+		t.Errorf("Expected database error, got %+v", report)
+	}
+
+	// Unless there's no spool to hold events.
+	spool.Close()
+	registerHealthChecks(tconf)
+	health.Refresh(context.Background())
+	code, report = get("/readyz")
+	if code != http.StatusServiceUnavailable || report.Status != health.STATUS_FAIL {
+		t.Errorf("Expected not ready without database or spool, got %d %+v", code, report)
+	}
+	db.Set(saved)
+	registerHealthChecks(tconf)
+
+	// Nor when a critical component is failing.
+	health.Register("critical", true, func(ctx context.Context) error { return errors.New("broken") })
+	health.Refresh(context.Background())
+	code, report = get("/healthz")
+	if code != http.StatusOK || report.Status != health.STATUS_FAIL {
+		t.Errorf("Expected alive but failing, got %d %+v", code, report)
+	}
+	code, report = get("/readyz")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready, got %d %+v", code, report)
+	}
+	health.Register("critical", true, func(ctx context.Context) error { return nil })
+	health.Refresh(context.Background())
+
+	ready.Store(false)
+	if code, report = get("/readyz"); code != http.StatusServiceUnavailable || report.Status != "draining" {
+		t.Errorf("Expected draining, got %d %+v", code, report)
+	}
+}
+
+// Test events are spooled while the database is unavailable, and stored once
+// it reconnects.
+func Test_DegradedMode(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	server := smtpmock.New(smtpmock.ConfigurationAttr{})
+	if err := server.Start(); err != nil {
+		panic(err)
+	}
+	defer server.Stop()
+	tconf.Mail = config.MailConfig{Host: "127.0.0.1", Port: fmt.Sprint(server.PortNumber())}
+	config.Set(tconf)
+	if err := spool.Init(t.TempDir(), tconf.SpoolLimit()); err != nil {
+		t.Fatal("Could not init spool:", err)
+	}
+	defer spool.Close()
+	saved := db.Current()
+	defer func() {
+		db.Set(saved)
+	}()
+
+	// Opening the database fails until its directory exists.
+	dbDir := filepath.Join(t.TempDir(), "later")
+	dbConf := tconf
+	dbConf.DatabaseUrl = filepath.Join(dbDir, "metrics.db")
+	if err := db.Init(dbConf); err == nil {
+		t.Fatal("Expected database to be unavailable")
+	}
+	db.Set(nil)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	post := func() {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(`{"event":"pageview","sessionid":"degraded"}`))
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Origin", "http://test.com")
+		req.Header.Set("User-Agent", "Degraded/1.0")
+		req.RemoteAddr = "10.1.2.3:4567"
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		post()
+	}
+	if n, _ := spool.Pending(); n != 3 {
+		t.Fatalf("Expected 3 spooled events, got %d", n)
+	}
+
+	// Contact form mail can't be logged or queued, so is sent directly.
+	req := httptest.NewRequest("POST", "/contact", strings.NewReader(`{"name":"Degraded","details":"degraded@example.com","msg":"sent without a database"}`))
+	req.Header.Set("Origin", "http://test.com")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected contact form to work without a database, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if msgs := server.Messages(); len(msgs) != 1 || !strings.Contains(msgs[0].MsgRequest(), "sent without a database") {
+		t.Errorf("Expected contact form mail to be sent directly, got %d messages", len(msgs))
+	}
+
+	oldMin, oldInterval := dbRetryMin, spoolRetryInterval
+	dbRetryMin, spoolRetryInterval = 10*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		dbRetryMin, spoolRetryInterval = oldMin, oldInterval
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	connected := make(chan bool)
+	consumed := make(chan bool)
+	go func() {
+		connectDB(ctx, dbConf)
+		close(connected)
+		consumeSpool(ctx)
+		close(consumed)
+	}()
+	defer cancel()
+	time.Sleep(50 * time.Millisecond)
+	if err := os.MkdirAll(dbDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected database to reconnect")
+	}
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if n, _ := spool.Pending(); n == 0 {
+			break
+		}
+	}
+	var events []db.EventLog
+	var count int64
+	if err := db.Current().Where("json_extract(raw_event, '$.SessionId') = ?", "degraded").Find(&events).Error; err != nil {
+		t.Fatal("Could not find replayed events:", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 replayed events, got %d", len(events))
+	}
+	if events[0].UserAgentID == 0 || events[0].VisitorID == "" || events[0].IP != "10.1.2.3" {
+		t.Errorf("Expected replayed event to be complete, got %+v", events[0])
+	}
+
+	// Events are still written to the spool first, and any left are stored
+	// when the consumer stops.
+	post()
+	cancel()
+	<-consumed
+	if n, _ := spool.Pending(); n != 0 {
+		t.Errorf("Expected spool to be empty after stopping, got %d", n)
+	}
+	if err := db.Current().Model(&db.EventLog{}).Where("json_extract(raw_event, '$.SessionId') = ?", "degraded").Count(&count).Error; err != nil || count != 4 {
+		t.Errorf("Expected 4 stored events, got %d, %v", count, err)
+	}
+}
+
+// Test failed mail is retried with backoff, then given up on until resent
+// from the dashboard.
+func Test_MailQueue(t *testing.T) {
+	server := smtpmock.New(smtpmock.ConfigurationAttr{
+		BlacklistedRcpttoEmails: []string{"bounce@queue.com"},
+	})
+	if err := server.Start(); err != nil {
+		panic(err)
+	}
+	defer server.Stop()
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Mail = config.MailConfig{Host: "127.0.0.1", Port: fmt.Sprint(server.PortNumber())}
+	config.Set(tconf)
+
+	oldMin, oldMax, oldAttempts := mailRetryMin, mailRetryMax, mailMaxAttempts
+	mailRetryMin, mailRetryMax, mailMaxAttempts = time.Minute, 4*time.Minute, 3
+	defer func() {
+		mailRetryMin, mailRetryMax, mailMaxAttempts = oldMin, oldMax, oldAttempts
+	}()
+	for attempts, want := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		if got := mailRetryDelay(attempts); got != want {
+			t.Errorf("Expected retry delay %s after %d attempts, got %s", want, attempts, got)
+		}
+	}
+
+	if err := queueMail(db.QueuedMail{Host: "test.com", From: "me@queue.com", To: "bounce@queue.com", Body: []byte("Subject: hi\r\n\r\nhi\r\n")}); err != nil {
+		t.Fatal("Could not queue mail:", err)
+	}
+	select {
+	case <-mailQueued:
+	default:
+		t.Error("Expected worker to be notified of queued mail")
+	}
+	m := db.QueuedMail{}
+	if err := db.Current().Where("`to` = ?", "bounce@queue.com").First(&m).Error; err != nil {
+		t.Fatal("Could not find queued mail:", err)
+	}
+	if details, err := checkMailQueue(context.Background()); err != nil || details["pending"].(int64) < 1 || details["oldest_seconds"] == nil {
+		t.Errorf("Expected pending mail in the health details, got %v, %v", details, err)
+	}
+
+	// Each failure is retried later, until giving up.
+	for attempt := 1; attempt <= 3; attempt++ {
+		if sent := sendDueMail(); sent != 0 {
+			t.Errorf("Expected mail to fail, sent %d", sent)
+		}
+		if err := db.First(&m, m.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if m.Attempts != attempt || m.LastError == "" {
+			t.Errorf("Expected %d failed attempts, got %+v", attempt, m)
+		}
+		if attempt < 3 && (m.Status != db.MAIL_PENDING || time.Until(m.NextAttempt) < 30*time.Second) {
+			t.Errorf("Expected mail to be retried later, got %+v", m)
+		}
+		// Make it due now.
+		db.Current().Model(&m).Update("next_attempt", time.Now())
+	}
+	if m.Status != db.MAIL_DEAD {
+		t.Errorf("Expected mail to be given up on, got %+v", m)
+	}
+	if _, err := checkMailQueue(context.Background()); err == nil {
+		t.Error("Expected mail queue health check to fail")
+	}
+
+	// Shown on the dashboard (escaped once), and can be resent.
+	db.Current().Model(&m).Update("last_error", "550 <bounce@queue.com> refused")
+	mux := http.NewServeMux()
+	setupTSHandlers(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/dashboard/test.com", nil))
+	resend := fmt.Sprintf("/dashboard/test.com/mail/%d/resend", m.ID)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), resend) {
+		t.Errorf("Expected dashboard to show undelivered mail, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "<div>550 &lt;bounce@queue.com&gt; refused</div>") {
+		t.Errorf("Expected dashboard to show the escaped error, got %s", rr.Body.String())
+	}
+	token := regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`).FindStringSubmatch(rr.Body.String())
+	if token == nil {
+		t.Fatalf("Expected resend form to include a CSRF token: %s", rr.Body.String())
+	}
+	for _, test := range []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", resend, token[1], http.StatusMethodNotAllowed},
+		{"POST", fmt.Sprintf("/dashboard/test2.com/mail/%d/resend", m.ID), token[1], http.StatusNotFound},
+		{"POST", resend, "", http.StatusForbidden}, // e.g. a form on another site
+		{"POST", resend, "0123abcd", http.StatusForbidden},
+		{"POST", resend, token[1], http.StatusSeeOther},
+		{"POST", resend, token[1], http.StatusNotFound}, // No longer undelivered
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(url.Values{"csrf_token": {test.token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		mux.ServeHTTP(rr, req)
+		if rr.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", test.method, test.path, test.code, rr.Code, rr.Body.String())
+		}
+	}
+	if err := db.First(&m, m.ID).Error; err != nil || m.Status != db.MAIL_PENDING || m.Attempts != 0 {
+		t.Errorf("Expected mail to be pending again, got %+v, %v", m, err)
+	}
+	if _, err := checkMailQueue(context.Background()); err != nil {
+		t.Error("Expected mail queue health check to pass, got", err)
+	}
+
+	// Sent once the recipient is accepted.
+	db.Current().Model(&m).Update("to", "ok@queue.com")
+	if sent := sendDueMail(); sent != 1 {
+		t.Errorf("Expected resent mail to be sent, sent %d", sent)
+	}
+	if err := db.First(&m, m.ID).Error; err != nil || m.Status != db.MAIL_SENT || m.Attempts != 1 {
+		t.Errorf("Expected mail to be sent, got %+v, %v", m, err)
+	}
+}
+
+// Test contact form submissions scored as spam are logged but not emailed.
+func Test_ContactSpam(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Sites[0].Spam = config.SpamConfig{RequireToken: true, ProofOfWorkBits: 4, BlockedKeywords: []string{"casino"}}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+	host := tconf.Sites[0].Host
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	req := httptest.NewRequest("GET", "/contact/token", nil)
+	req.Header.Set("Origin", "http://test.com")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	token := spam.Token{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &token); err != nil || rr.Code != http.StatusOK || token.ProofOfWorkBits != 4 {
+		t.Fatalf("Expected token, got %d %s: %v", rr.Code, rr.Body.String(), err)
+	}
+	if rr.Header().Get("Access-Control-Allow-Origin") != "http://test.com" {
+		t.Error("Expected CORS headers on token response")
+	}
+	// Issued long enough ago to be submitted.
+	ready := spam.Issue(host, time.Now().Add(-10*time.Second))
+
+	spamBefore := metrics.GetSiteData(host).Counts().Ignored[string(config.IGNORE_SPAM)]
+	emailBefore := metrics.GetSiteData(host).Counts().EventCount[metrics.EV_EMAIL]
+	for i, test := range []struct {
+		token, proof, website, msg string
+		spam                       bool
+	}{
+		{ready.Token, spam.Prove(ready.Token, 4), "", "spam test: hello", false},
+		{token.Token, spam.Prove(token.Token, 4), "", "spam test: too fast", true},
+		{"", "", "", "spam test: no token", true},
+		{ready.Token, spam.Prove(ready.Token, 4), "", "spam test: reused token", true},
+		{"", "", "http://x", "spam test: honeypot", true},
+	} {
+		body, _ := json.Marshal(map[string]string{"name": "me", "msg": test.msg, "token": test.token, "proof": test.proof, "website": test.website})
+		req := httptest.NewRequest("POST", "/contact", strings.NewReader(string(body)))
+		req.Header.Set("Origin", "http://test.com")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Test %d: expected %d, got %d", i, http.StatusOK, rr.Code)
+		}
+		m := db.MailLog{}
+		if err := db.Current().Where("msg = ?", test.msg).First(&m).Error; err != nil {
+			t.Fatalf("Test %d: expected submission to be logged: %v", i, err)
+		}
+		if spam := m.SpamScore >= config.DEFAULT_SPAM_THRESHOLD; spam != test.spam || (spam && m.SpamReasons == "") {
+			t.Errorf("Test %d: expected spam %v, got score %d (%s)", i, test.spam, m.SpamScore, m.SpamReasons)
+		}
+		queued, _ := db.Count(&db.QueuedMail{}, "mail_log_id = ?", m.ID)
+		if queued != 0 == test.spam {
+			t.Errorf("Test %d: expected spam %v, got %d queued", i, test.spam, queued)
+		}
+	}
+	if n := metrics.GetSiteData(host).Counts().Ignored[string(config.IGNORE_SPAM)] - spamBefore; n != 4 {
+		t.Errorf("Expected 4 submissions counted as spam, got %d", n)
+	}
+	if n := metrics.GetSiteData(host).Counts().EventCount[metrics.EV_EMAIL] - emailBefore; n != 1 {
+		t.Errorf("Expected 1 email counted, got %d", n)
+	}
+}
+
+// Test the contact form email can be customised per site, and that the HTML
+// version escapes the submission.
+func Test_ContactMail(t *testing.T) {
+	site := config.MonitoredSite{
+		Host:     "mail.com",
+		Contacts: []string{"Owner <owner@mail.com>", "sales@mail.com"},
+		ContactMail: config.ContactMailConfig{
+			From:         "Mail Site <web@mail.com>",
+			Subject:      "Enquiry from {{.Event.Name}}",
+			TextTemplate: "config/testdata/contact.tmpl",
+			HTMLTemplate: "config/testdata/contact.html",
+		},
+	}
+	event := db.MailLog{
+		ID:      42,
+		When:    time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Host:    "mail.com",
+		Name:    "Zoë <b>\r\nBcc: x@evil.com",
+		Details: " zoe@example.org ",
+		Msg:     "<script>alert(1)</script>",
+	}
+	queued, err := renderContactMail(site, event)
+	if err != nil {
+		t.Fatal("Could not render mail:", err)
+	}
+	if queued.MailLogID != 42 || queued.From != "web@mail.com" || queued.To != "owner@mail.com,sales@mail.com" {
+		t.Errorf("Unexpected queued mail %+v", queued)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(queued.Body))
+	if err != nil {
+		t.Fatalf("Could not parse mail: %v\n%s", err, queued.Body)
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("Expected no Bcc header to be injected: %s", queued.Body)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Enquiry from Zoë <b> Bcc: x@evil.com" {
+		t.Errorf("Unexpected subject %q", subject)
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err != nil || from.Name != "Mail Site" {
+		t.Errorf("Expected From to be Mail Site, got %v (%v)", from, err)
+	}
+	if replyTo, err := mail.ParseAddress(msg.Header.Get("Reply-To")); err != nil || replyTo.Address != "zoe@example.org" || replyTo.Name != event.Name {
+		t.Errorf("Expected Reply-To to be Zoë, got %v (%v)", replyTo, err)
+	}
+	if date, err := msg.Header.Date(); err != nil || !date.Equal(event.When) {
+		t.Errorf("Expected Date to be when submitted, got %s (%v)", date, err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	decoded, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	for _, expect := range []string{
+		"New enquiry for mail.com from Zoë",
+		"<script>alert(1)</script>\r\n", // Plain text is sent as is.
+		"<blockquote>&lt;script&gt;alert(1)&lt;/script&gt;</blockquote>",
+	} {
+		if !strings.Contains(string(decoded), expect) {
+			t.Errorf("Expected body to contain %q: %s", expect, decoded)
+		}
+	}
+
+	// Details which aren't an email address aren't replied to.
+	event.Details = "call 021 555 1234"
+	queued, err = renderContactMail(site, event)
+	if err != nil {
+		t.Fatal("Could not render mail:", err)
+	}
+	if bytes.Contains(queued.Body, []byte("Reply-To:")) {
+		t.Errorf("Expected no Reply-To: %s", queued.Body)
+	}
+}
+
+// Test submitters giving an email address are sent an acknowledgement, at
+// most once per address in the rate limit, and within the limits for each IP
+// and the site.
+func Test_AutoReply(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Sites[0].ContactMail.AutoReply = config.AutoReplyConfig{Enabled: true}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	for i, test := range []struct {
+		details string
+		ip      string
+		limits  config.AutoReplyConfig
+		status  db.AutoReplyStatus
+	}{
+		{"Auto.Reply@Example.com", "192.0.2.1", config.AutoReplyConfig{}, db.AUTOREPLY_QUEUED},
+		{"auto.reply@example.com", "192.0.2.1", config.AutoReplyConfig{}, db.AUTOREPLY_RATE_LIMITED},
+		{"Someone <other.reply@example.com>", "192.0.2.1", config.AutoReplyConfig{}, db.AUTOREPLY_QUEUED},
+		{"call me on 021 555 1234", "192.0.2.1", config.AutoReplyConfig{}, db.AUTOREPLY_NONE},
+		// This IP has been sent 2 already, but others haven't.
+		{"third.reply@example.com", "192.0.2.1", config.AutoReplyConfig{MaxPerIP: 2}, db.AUTOREPLY_RATE_LIMITED},
+		{"third.reply@example.com", "198.51.100.1", config.AutoReplyConfig{MaxPerIP: 2}, db.AUTOREPLY_QUEUED},
+		// The site has sent 3 this hour.
+		{"fourth.reply@example.com", "203.0.113.1", config.AutoReplyConfig{MaxPerHour: 3}, db.AUTOREPLY_RATE_LIMITED},
+	} {
+		tconf.Sites[0].ContactMail.AutoReply = test.limits
+		tconf.Sites[0].ContactMail.AutoReply.Enabled = true
+		config.Set(tconf)
+		msg := fmt.Sprintf("auto-reply test %d", i)
+		body, _ := json.Marshal(map[string]string{"name": "Visit spam.example", "details": test.details, "msg": msg})
+		req := httptest.NewRequest("POST", "/contact", strings.NewReader(string(body)))
+		req.RemoteAddr = test.ip + ":1234"
+		req.Header.Set("Origin", "http://test.com")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Test %d: expected %d, got %d", i, http.StatusOK, rr.Code)
+		}
+		m := db.MailLog{}
+		if err := db.Current().Where("msg = ?", msg).First(&m).Error; err != nil {
+			t.Fatalf("Test %d: expected submission to be logged: %v", i, err)
+		}
+		if m.AutoReply != test.status {
+			t.Errorf("Test %d: expected auto-reply %q, got %q", i, test.status, m.AutoReply)
+		}
+		var replies []db.QueuedMail
+		if err := db.Current().Where("mail_log_id = ? AND kind = ?", m.ID, db.MAIL_AUTOREPLY).Find(&replies).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (len(replies) == 1) != (test.status == db.AUTOREPLY_QUEUED) || len(replies) > 1 {
+			t.Fatalf("Test %d: expected auto-reply %q, got %d queued", i, test.status, len(replies))
+		}
+		if len(replies) == 0 {
+			continue
+		}
+		reply := string(replies[0].Body)
+		if replies[0].Host != "test.com" || !strings.Contains(reply, "Subject: Thanks for contacting test.com") || !strings.Contains(reply, "@example.com>") {
+			t.Errorf("Test %d: unexpected auto-reply %+v: %s", i, replies[0], reply)
+		}
+		if strings.Contains(reply, msg) || strings.Contains(reply, "spam.example") || strings.Contains(reply, "Someone") {
+			t.Errorf("Test %d: expected auto-reply not to include anything submitted: %s", i, reply)
+		}
+	}
+
+	// Erased with the submission it acknowledged: both contact mails and the
+	// one auto-reply.
+	erasure, err := db.EraseSubjectData(db.SubjectQuery{Email: "auto.reply@example.com"}, db.ERASE_DELETE, "", "test")
+	if err != nil || erasure.MailLogs != 2 || erasure.QueuedMail != 3 {
+		t.Errorf("Expected 2 mail logs and their 3 queued mails erased, got %+v, %v", erasure, err)
+	}
+}
+
+// Test sites can configure their contact form's fields, which are validated,
+// logged and emailed.
+func Test_ContactFormSchema(t *testing.T) {
+	tconf, err := config.LoadConfig("config/testdata/goodconfig.json")
+	if err != nil {
+		panic(err)
+	}
+	if err := db.Init(tconf); err != nil {
+		panic(err)
+	}
+	tconf.Sites[0].ContactForm = []config.FormField{
+		// Copied to the MailLog column of the same name, whatever its case.
+		{Name: "Name", Required: true},
+		{Name: "email", Label: "Email", Type: config.FIELD_EMAIL},
+		{Name: "phone", Label: "Phone", Type: config.FIELD_PHONE, Required: true},
+		{Name: "budget", Label: "Budget", Type: config.FIELD_NUMBER},
+		{Name: "topic", Label: "Topic", Type: config.FIELD_SELECT, Options: []string{"Sales", "Support"}},
+		{Name: "enquiry", Label: "Enquiry", Type: config.FIELD_TEXTAREA, MaxLength: 20},
+		{Name: "consent", Label: "Consent", Type: config.FIELD_CHECKBOX, Required: true},
+	}
+	if err := tconf.Validate(); err != nil {
+		panic(err)
+	}
+	config.Set(tconf)
+
+	mux := http.NewServeMux()
+	setupPublicHandlers(mux)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/contact", strings.NewReader(body))
+		req.Header.Set("Origin", "http://test.com")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	before, _ := db.Count(&db.MailLog{}, "host = ?", "test.com")
+	rr := post(`{"Name": "Schema", "email": "schema@", "budget": "lots", "topic": "Other", "enquiry": "far too long to be allowed", "consent": false}`)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("Expected %d with CORS headers, got %d: %v", http.StatusBadRequest, rr.Code, rr.Header())
+	}
+	var resp struct{ Errors map[string]string }
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal("Could not decode errors:", err)
+	}
+	for _, field := range []string{"email", "phone", "budget", "topic", "enquiry", "consent"} {
+		if resp.Errors[field] == "" {
+			t.Errorf("Expected an error for %s, got %v", field, resp.Errors)
+		}
+	}
+	if len(resp.Errors) != 6 {
+		t.Errorf("Expected 6 errors, got %v", resp.Errors)
+	}
+	if after, _ := db.Count(&db.MailLog{}, "host = ?", "test.com"); after != before {
+		t.Errorf("Expected invalid submission not to be logged, got %d more", after-before)
+	}
+
+	rr = post(`{"name": "Schema Tester", "email": "schema@example.com", "phone": "021 555 0000", "budget": 1500, "topic": "Support", "enquiry": "<b>help</b>", "consent": true, "unknown": "ignored"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	m := db.MailLog{}
+	if err := db.Current().Where("name = ?", "Schema Tester").First(&m).Error; err != nil {
+		t.Fatal("Expected submission to be logged:", err)
+	}
+	if len(m.Fields) != 7 || m.Fields.Get("budget") != "1500" || m.Fields.Get("consent") != "yes" || m.Fields.Get("unknown") != "" || m.Msg != "" {
+		t.Errorf("Unexpected fields logged %+v", m)
+	}
+	queued := db.QueuedMail{}
+	if err := db.Current().Where("mail_log_id = ?", m.ID).First(&queued).Error; err != nil {
+		t.Fatal("Expected mail to be queued:", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(queued.Body))
+	if err != nil {
+		t.Fatalf("Could not parse mail: %v\n%s", err, queued.Body)
+	}
+	if replyTo, err := mail.ParseAddress(msg.Header.Get("Reply-To")); err != nil || replyTo.Address != "schema@example.com" {
+		t.Errorf("Expected Reply-To from the email field, got %v (%v)", replyTo, err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	decoded, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	for _, expect := range []string{
+		"Phone: 021 555 0000\r\n",
+		"Topic: Support\r\n",
+		"Consent: yes\r\n",
+		"<b>help</b>\r\n",
+		"<tr><th align=\"left\">Budget</th><td>1500</td></tr>",
+		"&lt;b&gt;help&lt;/b&gt;",
+	} {
+		if !strings.Contains(string(decoded), expect) {
+			t.Errorf("Expected body to contain %q: %s", expect, decoded)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Marketing campaign parameters (utm_*) found in a page URL.
+type Campaign struct {
+	Source  string
+	Medium  string
+	Name    string // utm_campaign
+	Term    string
+	Content string
+}
+
+func (c Campaign) IsEmpty() bool {
+	return c == Campaign{}
+}
+
+// Extracts any campaign parameters from the query string of page.
+//
+// If strip is true, the returned page has the utm_* parameters removed,
+// otherwise page is returned unchanged. Pages which can't be parsed as a URL
+// are returned as is, with an empty Campaign.
+func ExtractCampaign(page string, strip bool) (Campaign, string) {
+	u, err := url.Parse(page)
+	if err != nil || u.RawQuery == "" {
+		return Campaign{}, page
+	}
+	q := u.Query()
+	c := Campaign{
+		Source:  q.Get("utm_source"),
+		Medium:  q.Get("utm_medium"),
+		Name:    q.Get("utm_campaign"),
+		Term:    q.Get("utm_term"),
+		Content: q.Get("utm_content"),
+	}
+	if !strip || c.IsEmpty() {
+		return c, page
+	}
+	for k := range q {
+		if strings.HasPrefix(k, "utm_") {
+			q.Del(k)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return c, u.String()
+}
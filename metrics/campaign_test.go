@@ -0,0 +1,32 @@
+package metrics
+
+import "testing"
+
+func Test_ExtractCampaign(t *testing.T) {
+	tests := []struct {
+		page     string
+		strip    bool
+		campaign Campaign
+		wantPage string
+	}{
+		{"https://test.com/", true, Campaign{}, "https://test.com/"},
+		{"https://test.com/?a=b", true, Campaign{}, "https://test.com/?a=b"},
+		{"https://test.com/?utm_source=news&utm_medium=email&utm_campaign=launch", false,
+			Campaign{Source: "news", Medium: "email", Name: "launch"},
+			"https://test.com/?utm_source=news&utm_medium=email&utm_campaign=launch"},
+		{"https://test.com/p?utm_source=news&utm_term=t&utm_content=c", true,
+			Campaign{Source: "news", Term: "t", Content: "c"}, "https://test.com/p"},
+		{"https://test.com/p?id=1&utm_source=news#top", true,
+			Campaign{Source: "news"}, "https://test.com/p?id=1#top"},
+		{"%zz?utm_source=x", true, Campaign{}, "%zz?utm_source=x"},
+	}
+	for i, test := range tests {
+		c, page := ExtractCampaign(test.page, test.strip)
+		if c != test.campaign {
+			t.Errorf("Test %d: expected campaign %+v, got %+v", i, test.campaign, c)
+		}
+		if page != test.wantPage {
+			t.Errorf("Test %d: expected page %s, got %s", i, test.wantPage, page)
+		}
+	}
+}
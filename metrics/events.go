@@ -1,6 +1,11 @@
 package metrics
 
-import "time"
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type EventType string
 
@@ -38,18 +43,129 @@ type Event struct {
 	Timestamp time.Time
 }
 
-// Live view of site metrics
+// Counts of a site's events, since program start.
+type SiteCounts struct {
+	EventCount map[EventType]uint
+	// EventCount broken down by country ("" if unknown)
+	CountryEventCount map[string]map[EventType]uint
+	// Events not fully recorded due to DNT/GPC signals
+	Suppressed map[EventType]uint
+	// Events ignored by reason (see config.IgnoreReason)
+	Ignored map[string]uint
+}
+
+// Live view of site metrics, updated by request handlers and read by the
+// Prometheus collector concurrently.
 type SiteData struct {
-	EventCount map[EventType]uint // since program start
+	mu     sync.Mutex
+	counts SiteCounts
+
+	visitorDay string          // UTC day that visitors are being counted for
+	visitors   map[string]bool // visitor IDs seen on visitorDay
 }
 
-var Sites = make(map[string]*SiteData)
+// Counts an event received from country (empty if unknown).
+func (s *SiteData) CountEvent(event EventType, country string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts.EventCount[event]++
+	if _, ok := s.counts.CountryEventCount[country]; !ok {
+		s.counts.CountryEventCount[country] = make(map[EventType]uint)
+	}
+	s.counts.CountryEventCount[country][event]++
+}
+
+// Counts an event not fully recorded due to DNT/GPC signals.
+func (s *SiteData) Suppress(event EventType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts.Suppressed[event]++
+}
+
+// Counts an event ignored for reason.
+func (s *SiteData) Ignore(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts.Ignored[reason]++
+}
+
+// Returns a copy of the site's counts.
+func (s *SiteData) Counts() SiteCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rv := SiteCounts{
+		EventCount:        maps.Clone(s.counts.EventCount),
+		CountryEventCount: make(map[string]map[EventType]uint, len(s.counts.CountryEventCount)),
+		Suppressed:        maps.Clone(s.counts.Suppressed),
+		Ignored:           maps.Clone(s.counts.Ignored),
+	}
+	for country, counts := range s.counts.CountryEventCount {
+		rv.CountryEventCount[country] = maps.Clone(counts)
+	}
+	return rv
+}
+
+func utcDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// Records a visit by the visitor with the given ID at t.
+func (s *SiteData) AddVisitor(t time.Time, id string) {
+	if id == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := utcDay(t)
+	if s.visitorDay != day {
+		s.visitorDay = day
+		s.visitors = make(map[string]bool)
+	}
+	s.visitors[id] = true
+}
+
+// Returns the number of unique visitors seen today (UTC).
+func (s *SiteData) VisitorsToday() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.visitorDay != utcDay(time.Now()) {
+		return 0
+	}
+	return len(s.visitors)
+}
+
+var (
+	sitesMu sync.Mutex
+	sites   = make(map[string]*SiteData)
+)
+
+// Service level counters, since program start
+var (
+	ConfigReloads        atomic.Uint64
+	ConfigReloadFailures atomic.Uint64
+)
 
 func GetSiteData(host string) *SiteData {
-	if _, ok := Sites[host]; !ok {
-		Sites[host] = &SiteData{EventCount: make(map[EventType]uint)}
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+	if _, ok := sites[host]; !ok {
+		sites[host] = &SiteData{
+			counts: SiteCounts{
+				EventCount:        make(map[EventType]uint),
+				CountryEventCount: make(map[string]map[EventType]uint),
+				Suppressed:        make(map[EventType]uint),
+				Ignored:           make(map[string]uint),
+			},
+		}
 	}
-	return Sites[host]
+	return sites[host]
+}
+
+// Returns the data of each site seen, by host.
+func Sites() map[string]*SiteData {
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+	return maps.Clone(sites)
 }
 
 func IsKnownEvent(event EventType) bool {
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test site data can be updated and read concurrently (run with -race).
+func Test_SiteDataConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s := GetSiteData("concurrent.test")
+			s.CountEvent(EV_PAGEVIEW, "NZ")
+			s.AddVisitor(time.Now(), fmt.Sprintf("visitor%d", i))
+			s.Suppress(EV_CONTEXT)
+			s.Ignore("bot")
+		}()
+		go func() {
+			defer wg.Done()
+			for _, s := range Sites() {
+				s.Counts()
+				s.VisitorsToday()
+			}
+		}()
+	}
+	wg.Wait()
+
+	s := GetSiteData("concurrent.test")
+	counts := s.Counts()
+	if counts.EventCount[EV_PAGEVIEW] != 10 || counts.CountryEventCount["NZ"][EV_PAGEVIEW] != 10 ||
+		counts.Suppressed[EV_CONTEXT] != 10 || counts.Ignored["bot"] != 10 || s.VisitorsToday() != 10 {
+		t.Errorf("Expected 10 of each, got %+v and %d visitors", counts, s.VisitorsToday())
+	}
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+type RefererClass string
+
+const (
+	REF_DIRECT   RefererClass = "direct"
+	REF_INTERNAL RefererClass = "internal"
+	REF_SEARCH   RefererClass = "search"
+	REF_SOCIAL   RefererClass = "social"
+	REF_EMAIL    RefererClass = "email"
+	REF_OTHER    RefererClass = "other"
+)
+
+// A referer, normalised and classified.
+type Referer struct {
+	Class  RefererClass
+	Source string // Name of the source, the domain if it isn't a known source.
+	Domain string // Normalised referring domain (or app package name).
+	URL    string // Referring URL without query string or fragment.
+}
+
+// The Source and Domain of referers which can't be parsed, rather than the
+// (client supplied) referer itself.
+const INVALID_REFERER = "(invalid)"
+
+// Prefixes removed from hosts when normalising.
+var ignoredHostPrefixes = []string{"www.", "m.", "mobile.", "amp."}
+
+// Parses and classifies a raw referer.
+//
+// internalHosts lists the hosts that belong to the site itself; referers from
+// them (or their subdomains) are classified as REF_INTERNAL.
+func ParseReferer(referer string, internalHosts ...string) Referer {
+	referer = strings.TrimSpace(referer)
+	if referer == "" {
+		return Referer{Class: REF_DIRECT, Source: "Direct"}
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return Referer{Class: REF_OTHER, Source: INVALID_REFERER, Domain: INVALID_REFERER}
+	}
+	domain := normaliseHost(u.Hostname())
+	rv := Referer{Class: REF_OTHER, Source: domain, Domain: domain}
+	if u.Scheme == "android-app" {
+		// android-app://<package>[/<scheme>/<host>/<path>], the package
+		// identifies the source.
+		rv.Domain = strings.ToLower(u.Host)
+		rv.Source = rv.Domain
+		rv.URL = u.Scheme + "://" + rv.Domain
+	} else {
+		rv.URL = u.Scheme + "://" + domain + strings.TrimSuffix(u.EscapedPath(), "/")
+	}
+
+	for _, host := range internalHosts {
+		host = normaliseHost(host)
+		if host != "" && (rv.Domain == host || strings.HasSuffix(rv.Domain, "."+host)) {
+			rv.Class = REF_INTERNAL
+			rv.Source = "Internal"
+			return rv
+		}
+	}
+	if src, ok := lookupSource(rv.Domain); ok {
+		rv.Class = src.Class
+		rv.Source = src.Name
+	}
+	return rv
+}
+
+// Lowercases host, removes any port and common prefixes such as www. unless
+// only a public suffix would remain (e.g. amp.dev).
+func normaliseHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, prefix := range ignoredHostPrefixes {
+		rest, found := strings.CutPrefix(host, prefix)
+		if !found {
+			continue
+		}
+		if _, err := publicsuffix.EffectiveTLDPlusOne(rest); err == nil {
+			host = rest
+		}
+	}
+	return host
+}
+
+// Finds domain, or the closest parent domain in the source list.
+func lookupSource(domain string) (refererSource, bool) {
+	for d := domain; d != ""; {
+		if src, ok := refererSources[d]; ok {
+			return src, true
+		}
+		_, parent, found := strings.Cut(d, ".")
+		if !found {
+			break
+		}
+		d = parent
+	}
+	// Search engines with many country specific domains (google.co.nz, ...),
+	// matched against the registrable domain so google.example.com isn't.
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		stem, _, _ := strings.Cut(registered, ".")
+		if src, ok := refererSearchStems[stem]; ok {
+			return src, true
+		}
+	}
+	return refererSource{}, false
+}
@@ -0,0 +1,68 @@
+package metrics
+
+type refererSource struct {
+	Name  string
+	Class RefererClass
+}
+
+// Known referer sources, keyed by normalised domain or Android app package.
+//
+// Subdomains of a listed domain match the same source.
+var refererSources = map[string]refererSource{
+	// Search
+	"bing.com":         {"Bing", REF_SEARCH},
+	"duckduckgo.com":   {"DuckDuckGo", REF_SEARCH},
+	"search.brave.com": {"Brave", REF_SEARCH},
+	"ecosia.org":       {"Ecosia", REF_SEARCH},
+	"kagi.com":         {"Kagi", REF_SEARCH},
+	"search.yahoo.com": {"Yahoo", REF_SEARCH},
+	"baidu.com":        {"Baidu", REF_SEARCH},
+	"startpage.com":    {"Startpage", REF_SEARCH},
+	"qwant.com":        {"Qwant", REF_SEARCH},
+	"perplexity.ai":    {"Perplexity", REF_SEARCH},
+	"chatgpt.com":      {"ChatGPT", REF_SEARCH},
+	"com.google.android.googlequicksearchbox": {"Google", REF_SEARCH},
+	"com.google.android.gm":                   {"Gmail", REF_EMAIL},
+
+	// Social
+	"facebook.com":               {"Facebook", REF_SOCIAL},
+	"instagram.com":              {"Instagram", REF_SOCIAL},
+	"twitter.com":                {"Twitter", REF_SOCIAL},
+	"t.co":                       {"Twitter", REF_SOCIAL},
+	"x.com":                      {"Twitter", REF_SOCIAL},
+	"linkedin.com":               {"LinkedIn", REF_SOCIAL},
+	"lnkd.in":                    {"LinkedIn", REF_SOCIAL},
+	"reddit.com":                 {"Reddit", REF_SOCIAL},
+	"news.ycombinator.com":       {"Hacker News", REF_SOCIAL},
+	"lobste.rs":                  {"Lobsters", REF_SOCIAL},
+	"youtube.com":                {"YouTube", REF_SOCIAL},
+	"mastodon.social":            {"Mastodon", REF_SOCIAL},
+	"bsky.app":                   {"Bluesky", REF_SOCIAL},
+	"threads.net":                {"Threads", REF_SOCIAL},
+	"pinterest.com":              {"Pinterest", REF_SOCIAL},
+	"com.facebook.katana":        {"Facebook", REF_SOCIAL},
+	"com.linkedin.android":       {"LinkedIn", REF_SOCIAL},
+	"com.reddit.frontpage":       {"Reddit", REF_SOCIAL},
+	"com.twitter.android":        {"Twitter", REF_SOCIAL},
+	"org.telegram.messenger":     {"Telegram", REF_SOCIAL},
+	"com.slack":                  {"Slack", REF_SOCIAL},
+	"com.instagram.android":      {"Instagram", REF_SOCIAL},
+	"com.google.android.youtube": {"YouTube", REF_SOCIAL},
+
+	// Email
+	"mail.google.com":              {"Gmail", REF_EMAIL},
+	"outlook.live.com":             {"Outlook", REF_EMAIL},
+	"outlook.office.com":           {"Outlook", REF_EMAIL},
+	"outlook.office365.com":        {"Outlook", REF_EMAIL},
+	"mail.yahoo.com":               {"Yahoo Mail", REF_EMAIL},
+	"mail.proton.me":               {"Proton Mail", REF_EMAIL},
+	"fastmail.com":                 {"Fastmail", REF_EMAIL},
+	"com.microsoft.office.outlook": {"Outlook", REF_EMAIL},
+}
+
+// Search engines matched by domain prefix, to cover country domains such as
+// google.co.nz or yandex.ru.
+var refererSearchStems = map[string]refererSource{
+	"google": {"Google", REF_SEARCH},
+	"yandex": {"Yandex", REF_SEARCH},
+}
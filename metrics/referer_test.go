@@ -0,0 +1,39 @@
+package metrics
+
+import "testing"
+
+func Test_ParseReferer(t *testing.T) {
+	tests := []struct {
+		referer string
+		want    Referer
+	}{
+		{"", Referer{Class: REF_DIRECT, Source: "Direct"}},
+		{"https://www.google.com/", Referer{REF_SEARCH, "Google", "google.com", "https://google.com"}},
+		{"https://google.com/search?q=metrics", Referer{REF_SEARCH, "Google", "google.com", "https://google.com/search"}},
+		{"https://www.google.co.nz/", Referer{REF_SEARCH, "Google", "google.co.nz", "https://google.co.nz"}},
+		{"android-app://com.google.android.googlequicksearchbox/https/www.google.com",
+			Referer{REF_SEARCH, "Google", "com.google.android.googlequicksearchbox", "android-app://com.google.android.googlequicksearchbox"}},
+		{"https://M.Facebook.com/story?id=1#x", Referer{REF_SOCIAL, "Facebook", "facebook.com", "https://facebook.com/story"}},
+		{"https://old.reddit.com/r/golang/", Referer{REF_SOCIAL, "Reddit", "old.reddit.com", "https://old.reddit.com/r/golang"}},
+		{"https://mail.google.com/mail/u/0/", Referer{REF_EMAIL, "Gmail", "mail.google.com", "https://mail.google.com/mail/u/0"}},
+		{"http://test.com:8080/page", Referer{REF_INTERNAL, "Internal", "test.com", "http://test.com/page"}},
+		{"https://blog.test.com/", Referer{REF_INTERNAL, "Internal", "blog.test.com", "https://blog.test.com"}},
+		{"https://www.google.com.au/", Referer{REF_SEARCH, "Google", "google.com.au", "https://google.com.au"}},
+		{"https://google.evil.com/", Referer{REF_OTHER, "google.evil.com", "google.evil.com", "https://google.evil.com"}},
+		{"https://yandex.example.org/", Referer{REF_OTHER, "yandex.example.org", "yandex.example.org", "https://yandex.example.org"}},
+		{"https://example.org/links?ref=1", Referer{REF_OTHER, "example.org", "example.org", "https://example.org/links"}},
+		{"not a url", Referer{REF_OTHER, INVALID_REFERER, INVALID_REFERER, ""}},
+		{"<script>alert(1)</script>", Referer{REF_OTHER, INVALID_REFERER, INVALID_REFERER, ""}},
+		// Prefixes are part of the domain when only a public suffix follows.
+		{"https://amp.dev/x", Referer{REF_OTHER, "amp.dev", "amp.dev", "https://amp.dev/x"}},
+		{"https://mobile.de/", Referer{REF_OTHER, "mobile.de", "mobile.de", "https://mobile.de"}},
+		{"https://m.me/", Referer{REF_OTHER, "m.me", "m.me", "https://m.me"}},
+		{"https://www.m.me/", Referer{REF_OTHER, "m.me", "m.me", "https://m.me"}},
+	}
+	for i, test := range tests {
+		got := ParseReferer(test.referer, "www.test.com")
+		if got != test.want {
+			t.Errorf("Test %d: ParseReferer(%q) = %+v, want %+v", i, test.referer, got, test.want)
+		}
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/health"
 	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/spool"
 )
 
 // Implements prometheus Collector interface to export event data
+//
+// The collector is unchecked (Describe sends nothing) as the labels of
+// events_total depend on the current config, which can be reloaded.
 type Collector struct {
 }
 
@@ -20,10 +27,81 @@ var (
 		"Number of events",
 		[]string{"event", "site"}, nil,
 	)
+	mCountryEvents = prometheus.NewDesc(
+		"events_total",
+		"Number of events",
+		[]string{"event", "site", "country"}, nil,
+	)
+	mSuppressed = prometheus.NewDesc(
+		"events_suppressed_total",
+		"Number of events not fully recorded due to DNT/GPC privacy signals",
+		[]string{"event", "site"}, nil,
+	)
+	mIgnored = prometheus.NewDesc(
+		"events_ignored_total",
+		"Number of events ignored due to the IgnoreNets, IgnorePaths or IgnoreUserAgents config",
+		[]string{"reason", "site"}, nil,
+	)
+	mComponentUp = prometheus.NewDesc(
+		"component_up",
+		"Whether a component the service depends on is healthy (1) or failing (0)",
+		[]string{"component"}, nil,
+	)
+	mSpoolEvents = prometheus.NewDesc(
+		"spool_events",
+		"Number of events spooled on disk waiting to be stored in the database",
+		nil, nil,
+	)
+	mSpoolBytes = prometheus.NewDesc(
+		"spool_bytes",
+		"Size of the events spooled on disk",
+		nil, nil,
+	)
+	mSpoolDropped = prometheus.NewDesc(
+		"spool_dropped_total",
+		"Number of events dropped because the spool was full",
+		nil, nil,
+	)
+	mSpoolLag = prometheus.NewDesc(
+		"spool_lag_seconds",
+		"How long the oldest spooled event has been waiting to be stored in the database",
+		nil, nil,
+	)
+	mSpoolConsumed = prometheus.NewDesc(
+		"spool_consumed_total",
+		"Number of spooled events stored in the database",
+		nil, nil,
+	)
+	mSpoolCorrupt = prometheus.NewDesc(
+		"spool_corrupt_total",
+		"Number of times spooled events were skipped as they failed their checksum",
+		nil, nil,
+	)
+	mMailQueue = prometheus.NewDesc(
+		"mail_queue",
+		"Number of contact form emails in the queue, by status",
+		[]string{"status"}, nil,
+	)
+	mVisitors = prometheus.NewDesc(
+		"visitors_today",
+		"Number of unique visitors today (UTC)",
+		[]string{"site"}, nil,
+	)
+
+	// Service stats
+	mConfigReloads = prometheus.NewDesc(
+		"config_reloads_total",
+		"Number of successful config reloads",
+		nil, nil,
+	)
+	mConfigReloadFailures = prometheus.NewDesc(
+		"config_reload_failures_total",
+		"Number of config reloads rejected due to errors",
+		nil, nil,
+	)
 )
 
 func (c Collector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(c, ch)
 }
 
 // Helper to export a counter metric
@@ -72,9 +150,49 @@ func (m collectMap) Inc(key string) {
 }
 
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
-	for site, data := range metrics.Sites {
-		for event, count := range data.EventCount {
-			c.emitCounter(count, time.Now(), mEvents, ch, string(event), site)
+	countryLabel := config.Current().PromCountryLabel
+	for site, data := range metrics.Sites() {
+		counts := data.Counts()
+		if countryLabel {
+			for country, counts := range counts.CountryEventCount {
+				for event, count := range counts {
+					c.emitCounter(count, time.Now(), mCountryEvents, ch, string(event), site, country)
+				}
+			}
+		} else {
+			for event, count := range counts.EventCount {
+				c.emitCounter(count, time.Now(), mEvents, ch, string(event), site)
+			}
+		}
+		for event, count := range counts.Suppressed {
+			c.emitCounter(count, time.Now(), mSuppressed, ch, string(event), site)
+		}
+		for reason, count := range counts.Ignored {
+			c.emitCounter(count, time.Now(), mIgnored, ch, reason, site)
+		}
+		c.emitGauge(site, float64(data.VisitorsToday()), time.Now(), mVisitors, ch)
+	}
+	for name, status := range health.Latest().Components {
+		switch status.Status {
+		case health.STATUS_OK:
+			c.emitGauge(name, 1, time.Now(), mComponentUp, ch)
+		case health.STATUS_FAIL:
+			c.emitGauge(name, 0, time.Now(), mComponentUp, ch)
+		}
+	}
+	events, bytes := spool.Pending()
+	ch <- prometheus.MustNewConstMetric(mSpoolEvents, prometheus.GaugeValue, float64(events))
+	ch <- prometheus.MustNewConstMetric(mSpoolBytes, prometheus.GaugeValue, float64(bytes))
+	totals := spool.Totals()
+	c.emitCounter(totals.Dropped, time.Now(), mSpoolDropped, ch)
+	ch <- prometheus.MustNewConstMetric(mSpoolLag, prometheus.GaugeValue, spool.Lag().Seconds())
+	c.emitCounter(totals.Consumed, time.Now(), mSpoolConsumed, ch)
+	c.emitCounter(totals.Corrupt, time.Now(), mSpoolCorrupt, ch)
+	if counts, err := db.CountMail(); err == nil {
+		for _, status := range []db.MailStatus{db.MAIL_PENDING, db.MAIL_SENT, db.MAIL_DEAD} {
+			c.emitGauge(string(status), float64(counts[status]), time.Now(), mMailQueue, ch)
 		}
 	}
+	c.emitCounter(uint(metrics.ConfigReloads.Load()), time.Now(), mConfigReloads, ch)
+	c.emitCounter(uint(metrics.ConfigReloadFailures.Load()), time.Now(), mConfigReloadFailures, ch)
 }
@@ -0,0 +1,88 @@
+// Copyright © 2023 Matt Brown.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/geoip"
+	"mattb.nz/web/metrics/metrics"
+)
+
+// Reloads the config from filename, swapping it in for all consumers if it is
+// valid. On any error the current config is kept.
+func reloadConfig(filename string) error {
+	newConf, err := config.LoadConfig(filename)
+	if err != nil {
+		metrics.ConfigReloadFailures.Add(1)
+		return err
+	}
+	old := config.Current()
+	if newConf.GeoIPDatabase != old.GeoIPDatabase {
+		if err := geoip.Init(newConf); err != nil {
+			metrics.ConfigReloadFailures.Add(1)
+			return err
+		}
+	}
+	config.Set(newConf)
+	metrics.ConfigReloads.Add(1)
+
+	added, removed, changed := old.SiteChanges(newConf)
+	log.Printf("Reloaded config from %s: sites added %v, removed %v, changed %v", filename, added, removed, changed)
+	if !reflect.DeepEqual(old.IgnoreNets, newConf.IgnoreNets) {
+		log.Printf("IgnoreNets changed from %v to %v", old.IgnoreNets, newConf.IgnoreNets)
+	}
+	if newConf.DatabaseUrl != old.DatabaseUrl || newConf.StateDirectory != old.StateDirectory {
+		log.Printf("DatabaseUrl or StateDirectory changed, a restart is required for this to take effect")
+	}
+	if newConf.Admin.Mode != old.Admin.Mode || newConf.Admin.Listen != old.Admin.Listen {
+		log.Printf("Admin.Mode or Admin.Listen changed, a restart is required for this to take effect")
+	}
+	return nil
+}
+
+// Returns a token which changes whenever filename is modified.
+func configVersion(filename string) string {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", st.ModTime().UnixNano(), st.Size())
+}
+
+// Reloads the config on SIGHUP, or when filename changes (checked every
+// interval), until ctx is done.
+func watchConfig(ctx context.Context, filename string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	version := configVersion(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			v := configVersion(filename)
+			if v == version || v == "" {
+				continue
+			}
+			log.Printf("%s changed, reloading config", filename)
+		}
+		version = configVersion(filename)
+		if err := reloadConfig(filename); err != nil {
+			log.Printf("Config reload failed, keeping current config: %v", err)
+		}
+	}
+}
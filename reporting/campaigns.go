@@ -0,0 +1,100 @@
+package reporting
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/templates"
+)
+
+// Returns the number of days of history requested via the days query
+// parameter, defaulting to 30.
+func reportDays(r *http.Request) int {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		return 30
+	}
+	return days
+}
+
+func Campaigns(w http.ResponseWriter, r *http.Request) {
+	page, err := templates.GetHTML("campaigns.html")
+	if err != nil {
+		log.Printf("Could not load campaigns page template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	site := r.PathValue("site")
+	if site == "" {
+		http.Error(w, "Bad Request", http.StatusNotFound)
+		return
+	}
+	if !access.Allowed(w, r, site) {
+		return
+	}
+	days := reportDays(r)
+	page.Execute(w, map[string]any{
+		"Site":      site,
+		"Days":      days,
+		"Campaigns": siteCampaigns(siteConfig(site), days),
+	})
+}
+
+type CampaignStats struct {
+	Source      string
+	Medium      string
+	Campaign    string
+	Sessions    int
+	Pageviews   int
+	Conversions int
+}
+
+// Reports traffic per source/medium/campaign.
+//
+// Sessions are attributed to the campaign of the first tagged pageview seen
+// for that session; a session converts if it clicked any of the site's goals.
+func siteCampaigns(site config.MonitoredSite, days int) (rv []CampaignStats) {
+	conn := db.Current()
+	if conn == nil {
+		return rv
+	}
+	since := time.Now().AddDate(0, 0, -days)
+	rows, err := conn.Raw(`
+WITH sessions AS (
+	SELECT session_id AS session, utm_source, utm_medium, utm_campaign, MIN(id)
+	FROM event_logs
+	WHERE host = ? AND `+"`when`"+` > ? AND json_extract(raw_event, '$.Event') = ?
+		AND session_id != '' AND (utm_source != '' OR utm_medium != '' OR utm_campaign != '')
+	GROUP BY session
+)
+SELECT s.utm_source, s.utm_medium, s.utm_campaign,
+	COUNT(DISTINCT s.session) AS sessions,
+	SUM(json_extract(e.raw_event, '$.Event') = ?) AS pageviews,
+	COUNT(DISTINCT CASE WHEN json_extract(e.raw_event, '$.Event') = ? AND json_extract(e.raw_event, '$.Target') IN ? THEN s.session END) AS conversions
+FROM sessions s
+JOIN event_logs e ON e.session_id = s.session AND e.host = ? AND e.`+"`when`"+` > ?
+GROUP BY s.utm_source, s.utm_medium, s.utm_campaign
+ORDER BY sessions DESC`,
+		site.Host, since, metrics.EV_PAGEVIEW,
+		metrics.EV_PAGEVIEW, metrics.EV_CLICK, site.Goals, site.Host, since).Rows()
+	if err != nil {
+		log.Printf("Could not get site campaigns: %v", err)
+		return rv
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := CampaignStats{}
+		if err := rows.Scan(&c.Source, &c.Medium, &c.Campaign, &c.Sessions, &c.Pageviews, &c.Conversions); err != nil {
+			log.Printf("Could not get site campaigns: %v", err)
+			return rv
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
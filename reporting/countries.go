@@ -0,0 +1,74 @@
+package reporting
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/templates"
+)
+
+func Countries(w http.ResponseWriter, r *http.Request) {
+	page, err := templates.GetHTML("countries.html")
+	if err != nil {
+		log.Printf("Could not load countries page template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	site := r.PathValue("site")
+	if site == "" {
+		http.Error(w, "Bad Request", http.StatusNotFound)
+		return
+	}
+	if !access.Allowed(w, r, site) {
+		return
+	}
+	siteConfig := siteConfig(site)
+	if siteConfig.Host == "" {
+		http.NotFound(w, r)
+		return
+	}
+	days := reportDays(r)
+	page.Execute(w, map[string]any{
+		"Site":      site,
+		"Days":      days,
+		"Countries": siteCountries(siteConfig, days),
+	})
+}
+
+type CountryStats struct {
+	Country   string
+	Pageviews int
+	Visitors  int // Sum of daily unique visitors
+}
+
+func siteCountries(site config.MonitoredSite, days int) (rv []CountryStats) {
+	conn := db.Current()
+	if conn == nil {
+		return rv
+	}
+	rows, err := conn.Raw(`
+SELECT COALESCE(NULLIF(country, ''), 'Unknown') AS name, COUNT(*) AS pageviews, COUNT(DISTINCT NULLIF(visitor_id, ''))
+FROM event_logs
+WHERE host = ? AND json_extract(raw_event, '$.Event') = ? AND `+"`when`"+` > ?
+GROUP BY name
+ORDER BY pageviews DESC`, site.Host, metrics.EV_PAGEVIEW, time.Now().AddDate(0, 0, -days)).Rows()
+	if err != nil {
+		log.Printf("Could not get site countries: %v", err)
+		return rv
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := CountryStats{}
+		if err := rows.Scan(&c.Country, &c.Pageviews, &c.Visitors); err != nil {
+			log.Printf("Could not get site countries: %v", err)
+			return rv
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
@@ -0,0 +1,98 @@
+package reporting
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/templates"
+)
+
+func Devices(w http.ResponseWriter, r *http.Request) {
+	page, err := templates.GetHTML("devices.html")
+	if err != nil {
+		log.Printf("Could not load devices page template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	site := r.PathValue("site")
+	if site == "" {
+		http.Error(w, "Bad Request", http.StatusNotFound)
+		return
+	}
+	if !access.Allowed(w, r, site) {
+		return
+	}
+	siteConfig := siteConfig(site)
+	if siteConfig.Host == "" {
+		http.NotFound(w, r)
+		return
+	}
+	days := reportDays(r)
+	page.Execute(w, map[string]any{
+		"Site": site,
+		"Days": days,
+		"Breakdowns": []DeviceBreakdown{
+			{"Browser", siteDevices(siteConfig, days, "ua.browser")},
+			{"Operating System", siteDevices(siteConfig, days, "ua.os")},
+			{"Device", siteDevices(siteConfig, days, "ua.device")},
+		},
+	})
+}
+
+type DeviceBreakdown struct {
+	Title string
+	Rows  []DeviceStats
+}
+
+type DeviceStats struct {
+	Name      string
+	Pageviews int
+	LoadTime  float64 // Average, in ms
+	LCP       float64 // Average, in ms
+	FID       float64 // Average, in ms
+	CLS       float64 // Average
+}
+
+// Reports pageviews and average vitals grouped by a user_agents column.
+func siteDevices(site config.MonitoredSite, days int, column string) (rv []DeviceStats) {
+	conn := db.Current()
+	if conn == nil {
+		return rv
+	}
+	rows, err := conn.Raw(`
+SELECT COALESCE(NULLIF(`+column+`, ''), 'Unknown') AS name,
+	SUM(json_extract(e.raw_event, '$.Event') = ?) AS pageviews,
+	AVG(json_extract(e.raw_event, '$.LoadTime')),
+	AVG(json_extract(e.raw_event, '$.LCP')),
+	AVG(json_extract(e.raw_event, '$.FID')),
+	AVG(json_extract(e.raw_event, '$.CLS'))
+FROM event_logs e
+LEFT JOIN user_agents ua ON ua.id = e.user_agent_id
+WHERE e.host = ? AND e.`+"`when`"+` > ? AND json_extract(e.raw_event, '$.Event') IN ?
+GROUP BY name
+ORDER BY pageviews DESC`,
+		metrics.EV_PAGEVIEW, site.Host, time.Now().AddDate(0, 0, -days),
+		[]metrics.EventType{metrics.EV_PAGEVIEW, metrics.EV_VITALS}).Rows()
+	if err != nil {
+		log.Printf("Could not get site devices: %v", err)
+		return rv
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := DeviceStats{}
+		var load, lcp, fid, cls sql.NullFloat64
+		if err := rows.Scan(&d.Name, &d.Pageviews, &load, &lcp, &fid, &cls); err != nil {
+			log.Printf("Could not get site devices: %v", err)
+			return rv
+		}
+		d.LoadTime, d.LCP, d.FID, d.CLS = load.Float64, lcp.Float64, fid.Float64, cls.Float64
+		rv = append(rv, d)
+	}
+	return rv
+}
@@ -4,6 +4,8 @@ import (
 	"log"
 	"net/http"
 
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
 	"mattb.nz/web/metrics/templates"
 )
 
@@ -14,5 +16,5 @@ func Home(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	page.Execute(w, map[string]any{"Config": conf})
+	page.Execute(w, map[string]any{"Sites": config.Current().VisibleSites(access.FromRequest(r))})
 }
@@ -0,0 +1,41 @@
+package reporting
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/db"
+)
+
+// Queues contact form mail which couldn't be delivered to be sent again, then
+// returns to the site page.
+func ResendMail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	site := r.PathValue("site")
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if site == "" || err != nil {
+		http.Error(w, "Bad Request", http.StatusNotFound)
+		return
+	}
+	if !access.Allowed(w, r, site) || !access.CheckCSRF(w, r) {
+		return
+	}
+	if err := db.ResendMail(uint(id), site); errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "No undelivered mail with that ID", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Could not resend mail %d: %v", id, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Mail %d for %s queued to resend by %s", id, site, access.FromRequest(r))
+	http.Redirect(w, r, fmt.Sprintf("/dashboard/%s", site), http.StatusSeeOther)
+}
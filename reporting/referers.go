@@ -0,0 +1,163 @@
+package reporting
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"mattb.nz/web/metrics/access"
+	"mattb.nz/web/metrics/config"
+	"mattb.nz/web/metrics/db"
+	"mattb.nz/web/metrics/metrics"
+	"mattb.nz/web/metrics/templates"
+)
+
+func Referers(w http.ResponseWriter, r *http.Request) {
+	page, err := templates.GetHTML("referers.html")
+	if err != nil {
+		log.Printf("Could not load referers page template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	site := r.PathValue("site")
+	if site == "" {
+		http.Error(w, "Bad Request", http.StatusNotFound)
+		return
+	}
+	if !access.Allowed(w, r, site) {
+		return
+	}
+	days := reportDays(r)
+	domain := r.URL.Query().Get("domain")
+	data := map[string]any{
+		"Site":   site,
+		"Days":   days,
+		"Domain": domain,
+	}
+	referers := parsedReferers(siteConfig(site), days)
+	if domain != "" {
+		data["URLs"] = refererURLs(referers, domain)
+	} else {
+		data["Sources"] = refererSources(referers)
+		data["Domains"] = refererDomains(referers)
+	}
+	page.Execute(w, data)
+}
+
+type Referer struct {
+	Referer string
+	Count   int
+}
+
+// Referer counts for a source or domain.
+type RefererStats struct {
+	Class  metrics.RefererClass
+	Source string
+	Domain string
+	Count  int
+}
+
+type parsedReferer struct {
+	metrics.Referer
+	Raw   string
+	Count int
+}
+
+// Hosts which are considered part of the site for referer classification.
+func internalHosts(site config.MonitoredSite) []string {
+	hosts := []string{site.Host}
+	for _, origin := range site.AllowedOrigins {
+		if u, err := url.Parse(origin); err == nil && u.Host != "" {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return hosts
+}
+
+// Returns the parsed referers of pageviews on the site, with their counts.
+func parsedReferers(site config.MonitoredSite, days int) (rv []parsedReferer) {
+	conn := db.Current()
+	if conn == nil {
+		return rv
+	}
+	rows, err := conn.Raw("SELECT referer, COUNT(*) AS count FROM event_logs WHERE host = ? AND json_extract(raw_event, '$.Event') = ? AND `when` > ? GROUP BY referer", site.Host, metrics.EV_PAGEVIEW, time.Now().AddDate(0, 0, -days)).Rows()
+	if err != nil {
+		log.Printf("Could not get site referers: %v", err)
+		return rv
+	}
+	defer rows.Close()
+	hosts := internalHosts(site)
+	for rows.Next() {
+		var referer string
+		var count int
+		if err := rows.Scan(&referer, &count); err != nil {
+			log.Printf("Could not get site referers: %v", err)
+			return rv
+		}
+		rv = append(rv, parsedReferer{metrics.ParseReferer(referer, hosts...), referer, count})
+	}
+	return rv
+}
+
+// Sums referer counts by the provided key.
+func groupReferers(referers []parsedReferer, key func(parsedReferer) RefererStats) (rv []RefererStats) {
+	idx := make(map[RefererStats]int)
+	for _, ref := range referers {
+		k := key(ref)
+		if i, ok := idx[k]; ok {
+			rv[i].Count += ref.Count
+			continue
+		}
+		idx[k] = len(rv)
+		k.Count = ref.Count
+		rv = append(rv, k)
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Count > rv[j].Count
+	})
+	return rv
+}
+
+func refererSources(referers []parsedReferer) []RefererStats {
+	return groupReferers(referers, func(r parsedReferer) RefererStats {
+		return RefererStats{Class: r.Class, Source: r.Source}
+	})
+}
+
+func refererDomains(referers []parsedReferer) []RefererStats {
+	var external []parsedReferer
+	for _, r := range referers {
+		if r.Class != metrics.REF_DIRECT && r.Class != metrics.REF_INTERNAL {
+			external = append(external, r)
+		}
+	}
+	return groupReferers(external, func(r parsedReferer) RefererStats {
+		return RefererStats{Class: r.Class, Source: r.Source, Domain: r.Domain}
+	})
+}
+
+// Returns the full referring URLs for a domain.
+func refererURLs(referers []parsedReferer, domain string) (rv []Referer) {
+	for _, r := range referers {
+		if r.Domain == domain {
+			rv = append(rv, Referer{r.Raw, r.Count})
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Count > rv[j].Count
+	})
+	return rv
+}
+
+// Returns the top 10 external referring domains.
+func siteReferers(site config.MonitoredSite, days int) (rv []Referer) {
+	for _, d := range refererDomains(parsedReferers(site, days)) {
+		if len(rv) >= 10 {
+			break
+		}
+		rv = append(rv, Referer{d.Domain, d.Count})
+	}
+	return rv
+}
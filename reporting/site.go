@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"sort"
 	"time"
 
+	"mattb.nz/web/metrics/access"
 	"mattb.nz/web/metrics/config"
 	"mattb.nz/web/metrics/db"
 	"mattb.nz/web/metrics/metrics"
@@ -14,7 +14,7 @@ import (
 )
 
 func Site(w http.ResponseWriter, r *http.Request) {
-	page, err := templates.Get("site.html")
+	page, err := templates.GetHTML("site.html")
 	if err != nil {
 		log.Printf("Could not load site page template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -25,12 +25,23 @@ func Site(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusNotFound)
 		return
 	}
+	if !access.Allowed(w, r, site) {
+		return
+	}
 	siteConfig := siteConfig(site)
+	live := metrics.GetSiteData(site)
+	deadMail, err := db.DeadMail(site)
+	if err != nil {
+		log.Printf("Could not list undelivered mail for %s: %v", site, err)
+	}
 	page.Execute(w, map[string]any{
-		"Config":    conf,
-		"Site":      site,
-		"LiveData":  metrics.GetSiteData(site),
-		"DayTotals": getDayTotals(siteConfig),
+		"SiteConfig": siteConfig,
+		"Site":       site,
+		"LiveData":   live.Counts(),
+		"Visitors":   live.VisitorsToday(),
+		"DayTotals":  getDayTotals(siteConfig),
+		"DeadMail":   deadMail,
+		"CSRFToken":  access.CSRFToken(r),
 	})
 }
 
@@ -60,34 +71,13 @@ func siteHistory(site config.MonitoredSite, days int) (rv SiteHistory) {
 	} else {
 		rv["readtime"] = fmt.Sprintf("%d minutes", v)
 	}
-	rv["referers"] = siteReferers(site, days)
-	return rv
-}
-
-type Referer struct {
-	Referer string
-	Count   int
-}
-
-func siteReferers(site config.MonitoredSite, days int) (rv []Referer) {
-	rows, err := db.DB.Raw("SELECT referer, COUNT(*) AS count FROM event_logs WHERE host = ? AND json_extract(raw_event, '$.Event') = ? AND `when` > ? GROUP BY referer HAVING referer != '' ORDER BY count DESC LIMIT 10", site.Host, metrics.EV_PAGEVIEW, time.Now().AddDate(0, 0, -days)).Rows()
+	// Visitor IDs change daily, so this is the sum of daily unique visitors.
+	v, err = db.CountDistinct(db.EventLog{}, "visitor_id", "host = ? AND visitor_id != '' AND `when` > ?", site.Host, time.Now().AddDate(0, 0, -days))
 	if err != nil {
-		log.Printf("Could not get site referers: %v", err)
-		return rv
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var referer string
-		var count int
-		if err := rows.Scan(&referer, &count); err != nil {
-			log.Printf("Could not get site referers: %v", err)
-			return rv
-		}
-		rv = append(rv, Referer{referer, count})
+		rv["visitors"] = fmt.Sprintf("unavailable: %v", err)
+	} else {
+		rv["visitors"] = v
 	}
-	// Sort the results by count
-	sort.Slice(rv, func(i, j int) bool {
-		return rv[i].Count > rv[j].Count
-	})
+	rv["referers"] = siteReferers(site, days)
 	return rv
 }
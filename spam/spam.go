@@ -0,0 +1,246 @@
+// Spam defences for contact form submissions.
+//
+// Forms for sites with SpamConfig.RequireToken fetch a token (see Issue) when
+// loaded and submit it with the form. With ProofOfWorkBits set, the form must
+// also submit a Proof: a string such that the SHA-256 hash of token + ":" +
+// proof starts with that many zero bits.
+package spam
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+)
+
+// Scores added by each failed check.
+const (
+	SCORE_HONEYPOT  = 10 // The honeypot field was filled in.
+	SCORE_TOKEN     = 10 // The token was missing, invalid, expired or reused.
+	SCORE_TOO_FAST  = 5  // Submitted sooner than MinSubmitDelay after the token was issued.
+	SCORE_PROOF     = 10 // The proof of work was missing or invalid.
+	SCORE_PER_LINK  = 2  // Each link over MaxLinks.
+	SCORE_KEYWORD   = 5  // Each BlockedKeyword found.
+	tokenLifetime   = time.Hour
+	tokenRandomSize = 12
+)
+
+var (
+	randomKey     []byte
+	randomKeyOnce sync.Once
+
+	mu   sync.Mutex
+	used = make(map[string]bool) // Tokens submitted which haven't expired.
+	// The tokens in used, soonest to expire first.
+	expiries usedTokens
+)
+
+// The most tokens remembered as used. Once this many unexpired tokens have
+// been submitted, further submissions are rejected until some expire.
+var maxUsedTokens = 100000
+
+// A used token, and when it expires.
+type usedToken struct {
+	token  string
+	expiry time.Time
+}
+
+// A heap of used tokens, ordered by expiry.
+type usedTokens []usedToken
+
+func (h usedTokens) Len() int           { return len(h) }
+func (h usedTokens) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+func (h usedTokens) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *usedTokens) Push(x any)        { *h = append(*h, x.(usedToken)) }
+func (h *usedTokens) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// Returns the key tokens are signed with.
+func key() []byte {
+	if secret := config.Current().ContactTokenSecret; secret != "" {
+		return []byte(secret)
+	}
+	randomKeyOnce.Do(func() {
+		randomKey = make([]byte, 32)
+		rand.Read(randomKey)
+	})
+	return randomKey
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, key())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// A token for a contact form, as returned by /contact/token.
+type Token struct {
+	Token string
+	// Leading zero bits required of the proof of work, or 0 if none is.
+	ProofOfWorkBits int
+}
+
+// Issues a token for a form on host, loaded at now.
+func Issue(host string, now time.Time) Token {
+	nonce := make([]byte, tokenRandomSize)
+	rand.Read(nonce)
+	payload := base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%s|%d|%x", host, now.UnixMilli(), nonce))
+	return Token{
+		Token:           payload + "." + sign(payload),
+		ProofOfWorkBits: config.Current().GetSite(host).Spam.ProofOfWorkBits,
+	}
+}
+
+// Returns when token was issued, if it is valid for host.
+func parseToken(token, host string) (time.Time, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(payload))) {
+		return time.Time{}, fmt.Errorf("invalid token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid token: %w", err)
+	}
+	fields := strings.Split(string(b), "|")
+	if len(fields) != 3 || fields[0] != host {
+		return time.Time{}, fmt.Errorf("token is for another site")
+	}
+	ms, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid token: %w", err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+var (
+	errReused  = errors.New("token reused")
+	errTooMany = errors.New("too many tokens in use")
+)
+
+// Records token, issued at issued, was used at now, returning an error if it
+// already had been or too many tokens are in use.
+func markUsed(token string, issued, now time.Time) error {
+	mu.Lock()
+	defer mu.Unlock()
+	// Expired tokens are rejected before they're checked here, so needn't be
+	// remembered.
+	for len(expiries) > 0 && now.After(expiries[0].expiry) {
+		delete(used, heap.Pop(&expiries).(usedToken).token)
+	}
+	if used[token] {
+		return errReused
+	}
+	if len(used) >= maxUsedTokens {
+		return errTooMany
+	}
+	used[token] = true
+	heap.Push(&expiries, usedToken{token, issued.Add(tokenLifetime)})
+	return nil
+}
+
+// Returns true if proof is a valid proof of work for token.
+func CheckProof(token, proof string, bitsRequired int) bool {
+	if proof == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token + ":" + proof))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= bitsRequired
+}
+
+// Returns a proof of work for token, as a form would compute it.
+func Prove(token string, bitsRequired int) string {
+	for i := 0; ; i++ {
+		proof := strconv.Itoa(i)
+		if CheckProof(token, proof, bitsRequired) {
+			return proof
+		}
+	}
+}
+
+// A contact form submission, as checked for spam.
+type Submission struct {
+	Honeypot string
+	Token    string
+	Proof    string
+	// The free text fields, checked for links and BlockedKeywords.
+	Text []string
+}
+
+// The spam score of a submission, and why.
+type Result struct {
+	Score   int
+	Reasons []string
+}
+
+func (r *Result) add(score int, format string, args ...any) {
+	r.Score += score
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+var linkRe = regexp.MustCompile(`(?i)https?://|www\.|\[url`)
+
+// Scores s, a submission to the contact form of host at now.
+func Check(host string, s Submission, now time.Time) Result {
+	conf := config.Current().GetSite(host).Spam
+	r := Result{}
+	if s.Honeypot != "" {
+		r.add(SCORE_HONEYPOT, "honeypot")
+	}
+
+	if conf.RequireToken {
+		issued, err := parseToken(s.Token, host)
+		if s.Token == "" {
+			r.add(SCORE_TOKEN, "no token")
+		} else if err != nil {
+			r.add(SCORE_TOKEN, "%v", err)
+		} else if now.Sub(issued) > tokenLifetime {
+			r.add(SCORE_TOKEN, "token expired")
+		} else if err := markUsed(s.Token, issued, now); err != nil {
+			r.add(SCORE_TOKEN, "%v", err)
+		} else if now.Sub(issued) < conf.MinSubmitDelay() {
+			r.add(SCORE_TOO_FAST, "submitted %s after loading", now.Sub(issued).Round(time.Millisecond))
+		}
+		if conf.ProofOfWorkBits > 0 && !CheckProof(s.Token, s.Proof, conf.ProofOfWorkBits) {
+			r.add(SCORE_PROOF, "invalid proof of work")
+		}
+	}
+
+	text := strings.ToLower(strings.Join(s.Text, "\n"))
+	if links := len(linkRe.FindAllStringIndex(text, -1)); links > conf.MaxLinksOrDefault() {
+		r.add(SCORE_PER_LINK*(links-conf.MaxLinksOrDefault()), "%d links", links)
+	}
+	for _, kw := range conf.BlockedKeywords {
+		if strings.Contains(text, strings.ToLower(kw)) {
+			r.add(SCORE_KEYWORD, "keyword %q", kw)
+		}
+	}
+	return r
+}
+
+// Returns true if r scores as spam for host.
+func (r Result) IsSpam(host string) bool {
+	return r.Score >= config.Current().GetSite(host).Spam.ThresholdOrDefault()
+}
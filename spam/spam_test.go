@@ -0,0 +1,126 @@
+package spam
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"mattb.nz/web/metrics/config"
+)
+
+func setConfig(t *testing.T, spam config.SpamConfig) {
+	t.Helper()
+	conf := config.Config{
+		ContactTokenSecret: "secret",
+		Sites: []config.MonitoredSite{
+			{Host: "spam.com", AllowedOrigins: []string{"https://spam.com"}, Spam: spam},
+			{Host: "other.com", AllowedOrigins: []string{"https://other.com"}},
+		},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Set(conf)
+}
+
+func Test_Content(t *testing.T) {
+	setConfig(t, config.SpamConfig{BlockedKeywords: []string{"Crypto", "SEO services"}})
+	now := time.Now()
+	for _, test := range []struct {
+		s     Submission
+		score int
+	}{
+		{Submission{Text: []string{"Jo", "Hi, see https://example.com"}}, 0},
+		{Submission{Honeypot: "http://spam", Text: []string{"Jo", "hi"}}, SCORE_HONEYPOT},
+		{Submission{Text: []string{"http://a www.b https://c HTTPS://d"}}, 2 * SCORE_PER_LINK},
+		{Submission{Text: []string{"cheap seo SERVICES", "buy crypto"}}, 2 * SCORE_KEYWORD},
+		// Not checked unless required.
+		{Submission{Token: "bogus", Text: []string{"hi"}}, 0},
+	} {
+		r := Check("spam.com", test.s, now)
+		if r.Score != test.score {
+			t.Errorf("%+v: expected score %d, got %+v", test.s, test.score, r)
+		}
+		if r.IsSpam("spam.com") != (test.score >= config.DEFAULT_SPAM_THRESHOLD) {
+			t.Errorf("%+v: unexpected IsSpam for %+v", test.s, r)
+		}
+	}
+	setConfig(t, config.SpamConfig{MaxLinks: -1})
+	if r := Check("spam.com", Submission{Text: []string{"see https://example.com"}}, now); r.Score != SCORE_PER_LINK {
+		t.Errorf("Expected a link to score %d when none are allowed, got %+v", SCORE_PER_LINK, r)
+	}
+}
+
+func Test_Token(t *testing.T) {
+	setConfig(t, config.SpamConfig{RequireToken: true, ProofOfWorkBits: 8})
+	now := time.Now()
+	issue := func(host string, at time.Time) (string, string) {
+		tok := Issue(host, at)
+		if tok.ProofOfWorkBits != 8 && host == "spam.com" {
+			t.Errorf("Expected token to require 8 bits, got %+v", tok)
+		}
+		return tok.Token, Prove(tok.Token, 8)
+	}
+
+	good, proof := issue("spam.com", now.Add(-10*time.Second))
+	if r := Check("spam.com", Submission{Token: good, Proof: proof}, now); r.Score != 0 {
+		t.Errorf("Expected valid token to score 0, got %+v", r)
+	}
+	if r := Check("spam.com", Submission{Token: good, Proof: proof}, now); r.Score != SCORE_TOKEN || r.Reasons[0] != "token reused" {
+		t.Errorf("Expected reused token to score %d, got %+v", SCORE_TOKEN, r)
+	}
+
+	fast, proof := issue("spam.com", now.Add(-time.Second))
+	if r := Check("spam.com", Submission{Token: fast, Proof: proof}, now); r.Score != SCORE_TOO_FAST {
+		t.Errorf("Expected fast submission to score %d, got %+v", SCORE_TOO_FAST, r)
+	}
+	old, proof := issue("spam.com", now.Add(-2*time.Hour))
+	if r := Check("spam.com", Submission{Token: old, Proof: proof}, now); r.Score != SCORE_TOKEN {
+		t.Errorf("Expected expired token to score %d, got %+v", SCORE_TOKEN, r)
+	}
+	other, proof := issue("other.com", now.Add(-10*time.Second))
+	if r := Check("spam.com", Submission{Token: other, Proof: proof}, now); r.Score != SCORE_TOKEN {
+		t.Errorf("Expected token for another site to score %d, got %+v", SCORE_TOKEN, r)
+	}
+	tampered, _ := issue("spam.com", now.Add(-10*time.Second))
+	tampered = strings.Replace(tampered, ".", "x.", 1)
+	if r := Check("spam.com", Submission{Token: tampered, Proof: Prove(tampered, 8)}, now); r.Score != SCORE_TOKEN {
+		t.Errorf("Expected tampered token to score %d, got %+v", SCORE_TOKEN, r)
+	}
+	if r := Check("spam.com", Submission{}, now); r.Score != SCORE_TOKEN+SCORE_PROOF {
+		t.Errorf("Expected missing token to score %d, got %+v", SCORE_TOKEN+SCORE_PROOF, r)
+	}
+	noproof, _ := issue("spam.com", now.Add(-10*time.Second))
+	if r := Check("spam.com", Submission{Token: noproof, Proof: "x"}, now); !CheckProof(noproof, "x", 8) && r.Score != SCORE_PROOF {
+		t.Errorf("Expected invalid proof to score %d, got %+v", SCORE_PROOF, r)
+	}
+}
+
+// Test used tokens are forgotten once they expire, and at most maxUsedTokens
+// are remembered until then.
+func Test_UsedTokens(t *testing.T) {
+	setConfig(t, config.SpamConfig{RequireToken: true})
+	defer func(max int) { maxUsedTokens = max }(maxUsedTokens)
+	now := time.Now()
+	maxUsedTokens = len(used) + 2
+
+	for i := 0; i < 2; i++ {
+		tok := Issue("spam.com", now.Add(-10*time.Second)).Token
+		if r := Check("spam.com", Submission{Token: tok}, now); r.Score != 0 {
+			t.Errorf("Token %d: expected score 0, got %+v", i, r)
+		}
+	}
+	full := Issue("spam.com", now.Add(-10*time.Second)).Token
+	if r := Check("spam.com", Submission{Token: full}, now); r.Score != SCORE_TOKEN || r.Reasons[0] != errTooMany.Error() {
+		t.Errorf("Expected token to be rejected while full, got %+v", r)
+	}
+
+	later := now.Add(tokenLifetime)
+	tok := Issue("spam.com", later.Add(-10*time.Second)).Token
+	if r := Check("spam.com", Submission{Token: tok}, later); r.Score != 0 {
+		t.Errorf("Expected expired tokens to be forgotten, got %+v", r)
+	}
+	if len(used) != 1 || len(expiries) != 1 {
+		t.Errorf("Expected only the latest token to be remembered, got %d, %d", len(used), len(expiries))
+	}
+}
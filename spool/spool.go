@@ -0,0 +1,466 @@
+// A durable on-disk queue of events, written before they are stored in the
+// database so that none are lost while it's locked or unavailable, or if the
+// process restarts.
+//
+// The spool is a directory of append-only segment files, each holding a
+// sequence of records:
+//
+//	length  uint32 (big endian), of the payload
+//	crc     uint32, CRC-32C of the time and payload
+//	time    int64, when the record was appended (Unix nanoseconds)
+//	payload []byte, typically JSON
+//
+// Consume passes records to a store function in order, tracking its progress
+// in a cursor file and deleting segments once all their records are stored.
+// Delivery is at least once: records stored just before a crash may be passed
+// to store again after restarting.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	headerSize    = 16
+	// Larger records are assumed to be corrupt.
+	maxRecordSize = 1 << 20
+)
+
+// Size at which a new segment is started.
+var SegmentBytes int64 = 4 << 20
+
+var ErrFull = errors.New("spool is full")
+var ErrDisabled = errors.New("spool is not enabled")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A position in the spool.
+type position struct {
+	seq    uint64 // Of the segment
+	offset int64
+}
+
+var (
+	mu        sync.Mutex
+	consumeMu sync.Mutex // Held while consuming
+	dir       string
+	maxBytes  int64
+	active    *os.File // Segment being appended to, nil if not enabled
+	segments  []uint64 // Sequence numbers of the segments, oldest first
+	endOfSeg  int64    // Size of the active segment
+	cursor    position // Of the next record to consume
+	size      int64    // Of records not yet consumed
+	pending   int      // Records not yet consumed
+	oldest    time.Time
+	full      bool // The last Append was dropped
+	appended  = make(chan struct{}, 1)
+	counters  Counters
+)
+
+// Counters, since program start.
+type Counters struct {
+	Dropped  uint // Records not spooled because it was full
+	Consumed uint // Records successfully stored
+	Corrupt  uint // Segments skipped at a record which failed its checksum
+}
+
+func segmentPath(seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// Opens (creating if needed) the spool in directory d, holding up to max
+// bytes of records not yet consumed.
+//
+// Records left from a previous run are kept for Consume, after discarding any
+// partially written when it stopped.
+func Init(d string, max int64) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if active != nil {
+		active.Close()
+		active = nil
+	}
+	if err := os.MkdirAll(d, 0o700); err != nil {
+		return err
+	}
+	dir, maxBytes = d, max
+	segments, size, pending, oldest, full = nil, 0, 0, time.Time{}, false
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentSuffix)
+		var seq uint64
+		if _, err := fmt.Sscan(name, &seq); ok && err == nil {
+			segments = append(segments, seq)
+		}
+	}
+	slices.Sort(segments)
+	if cursor, err = readCursor(); err != nil {
+		return err
+	}
+
+	// Remove segments already consumed, then count what's left.
+	for len(segments) > 0 && segments[0] < cursor.seq {
+		if err := os.Remove(segmentPath(segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		segments = []uint64{cursor.seq + 1}
+	}
+	if cursor.seq < segments[0] {
+		cursor = position{segments[0], 0}
+	}
+	for i, seq := range segments {
+		start := int64(0)
+		if seq == cursor.seq {
+			start = cursor.offset
+		}
+		if err := recoverSegment(seq, start, i == len(segments)-1); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(segmentPath(segments[len(segments)-1]), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	active, endOfSeg = f, st.Size()
+	if pending > 0 {
+		log.Printf("Spool has %d events (%d bytes) waiting to be stored", pending, size)
+	}
+	return nil
+}
+
+// Counts the valid records in segment seq from offset start. In the last
+// segment, invalid records (e.g. partially written) are truncated.
+func recoverSegment(seq uint64, start int64, last bool) error {
+	f, err := os.OpenFile(segmentPath(seq), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if start > st.Size() {
+		start = st.Size()
+		cursor.offset = start
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, st.Size()-start))
+	for offset := start; offset < st.Size(); {
+		t, _, n, err := readRecord(r)
+		if err != nil {
+			if !last {
+				break // Skipped when consumed.
+			}
+			log.Printf("Truncating %d bytes of invalid records from spool segment %d: %v", st.Size()-offset, seq, err)
+			return f.Truncate(offset)
+		}
+		if pending == 0 {
+			oldest = t
+		}
+		pending++
+		size += n
+		offset += n
+	}
+	return nil
+}
+
+// Reads a record from r, returning its time, payload and total size.
+func readRecord(r io.Reader) (time.Time, []byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return time.Time{}, nil, 0, fmt.Errorf("could not read record header: %w", err)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return time.Time{}, nil, 0, fmt.Errorf("record length %d is too large", length)
+	}
+	// The time and payload, as covered by the checksum.
+	b := make([]byte, 8+length)
+	copy(b, header[8:])
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return time.Time{}, nil, 0, fmt.Errorf("could not read record: %w", err)
+	}
+	if crc32.Checksum(b, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return time.Time{}, nil, 0, errors.New("record checksum mismatch")
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+	return t, b[8:], int64(headerSize) + int64(length), nil
+}
+
+func encodeRecord(t time.Time, payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(b[8:16], uint64(t.UnixNano()))
+	copy(b[headerSize:], payload)
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(b[8:], crcTable))
+	return b
+}
+
+func readCursor() (position, error) {
+	b, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if os.IsNotExist(err) {
+		return position{}, nil
+	} else if err != nil {
+		return position{}, err
+	}
+	p := position{}
+	if _, err := fmt.Sscan(string(b), &p.seq, &p.offset); err != nil {
+		log.Printf("Ignoring invalid spool cursor %q: %v", b, err)
+		return position{}, nil
+	}
+	return p, nil
+}
+
+func writeCursor(p position) error {
+	path := filepath.Join(dir, cursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", p.seq, p.offset)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns true if the spool is open, so events can be held in it while the
+// database is unavailable.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return active != nil
+}
+
+// Closes the spool, after which Append returns ErrDisabled.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if active == nil {
+		return nil
+	}
+	err := errors.Join(active.Sync(), active.Close())
+	active = nil
+	return err
+}
+
+// Adds v (encoded as JSON) to the spool.
+func Append(v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return appendRecord(payload)
+}
+
+// Appends a record holding payload. Must be called with mu held.
+func appendRecord(payload []byte) error {
+	if active == nil {
+		return ErrDisabled
+	}
+	now := time.Now()
+	b := encodeRecord(now, payload)
+	if size+int64(len(b)) > maxBytes {
+		full = true
+		counters.Dropped++
+		return ErrFull
+	}
+	if endOfSeg > 0 && endOfSeg+int64(len(b)) > SegmentBytes {
+		if err := rollSegment(); err != nil {
+			return err
+		}
+	}
+	if _, err := active.Write(b); err != nil {
+		return err
+	}
+	if pending == 0 {
+		oldest = now
+	}
+	endOfSeg += int64(len(b))
+	size += int64(len(b))
+	pending++
+	full = false
+	select {
+	case appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Starts a new active segment. Must be called with mu held.
+func rollSegment() error {
+	seq := segments[len(segments)-1] + 1
+	f, err := os.OpenFile(segmentPath(seq), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := errors.Join(active.Sync(), active.Close()); err != nil {
+		log.Printf("Could not close spool segment: %v", err)
+	}
+	active, endOfSeg = f, 0
+	segments = append(segments, seq)
+	return nil
+}
+
+// Returns a channel which receives after records are appended.
+func Appended() <-chan struct{} {
+	return appended
+}
+
+// Returns the number of records waiting to be consumed and their size.
+func Pending() (int, int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	return pending, size
+}
+
+// Returns how long the oldest record not yet consumed has been waiting.
+func Lag() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	if pending == 0 {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Returns the spool's counters.
+func Totals() Counters {
+	mu.Lock()
+	defer mu.Unlock()
+	return counters
+}
+
+// Returns true if the spool is enabled and dropping records as it is full.
+func Full() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return active != nil && full
+}
+
+// Passes each record not yet consumed, oldest first, to store. Records are
+// consumed once stored. If store fails, consuming stops and the failed record
+// and those after it are kept for the next call. Returns the number consumed.
+func Consume(store func(record []byte) error) (int, error) {
+	consumeMu.Lock()
+	defer consumeMu.Unlock()
+
+	mu.Lock()
+	if active == nil {
+		mu.Unlock()
+		return 0, ErrDisabled
+	}
+	if err := active.Sync(); err != nil {
+		log.Printf("Could not sync spool segment: %v", err)
+	}
+	segs := slices.Clone(segments)
+	activeSeq, activeEnd, start := segs[len(segs)-1], endOfSeg, cursor
+	mu.Unlock()
+
+	pos := start
+	defer func() {
+		if pos != start {
+			if err := writeCursor(pos); err != nil {
+				log.Printf("Could not save spool cursor: %v", err)
+			}
+		}
+	}()
+	consumed := 0
+	for _, seq := range segs {
+		if seq < pos.seq {
+			continue
+		}
+		end := activeEnd
+		if seq != activeSeq {
+			st, err := os.Stat(segmentPath(seq))
+			if err != nil {
+				return consumed, err
+			}
+			end = st.Size()
+		}
+		n, err := consumeSegment(seq, &pos, end, store)
+		consumed += n
+		if err != nil || seq == activeSeq {
+			return consumed, err
+		}
+		// All its records are stored, so the segment is no longer needed.
+		pos = position{seq + 1, 0}
+		if err := writeCursor(pos); err != nil {
+			return consumed, err
+		}
+		mu.Lock()
+		segments = slices.DeleteFunc(segments, func(s uint64) bool { return s == seq })
+		cursor = pos
+		mu.Unlock()
+		if err := os.Remove(segmentPath(seq)); err != nil {
+			return consumed, err
+		}
+	}
+	return consumed, nil
+}
+
+// Consumes the records of segment seq from pos up to end, advancing pos.
+func consumeSegment(seq uint64, pos *position, end int64, store func([]byte) error) (int, error) {
+	f, err := os.Open(segmentPath(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.NewSectionReader(f, pos.offset, end-pos.offset))
+	consumed := 0
+	for pos.offset < end {
+		t, payload, n, err := readRecord(r)
+		if err != nil {
+			// The following records can't be found, so skip them.
+			log.Printf("Skipping %d bytes of spool segment %d: %v", end-pos.offset, seq, err)
+			mu.Lock()
+			counters.Corrupt++
+			pos.offset = end
+			cursor = *pos
+			mu.Unlock()
+			break
+		}
+		if err := store(payload); err != nil {
+			mu.Lock()
+			oldest = t
+			mu.Unlock()
+			return consumed, fmt.Errorf("could not store spooled event: %w", err)
+		}
+		pos.offset += n
+		consumed++
+		mu.Lock()
+		pending--
+		size -= n
+		full = false
+		counters.Consumed++
+		cursor = *pos
+		mu.Unlock()
+	}
+	return consumed, nil
+}
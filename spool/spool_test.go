@@ -0,0 +1,197 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type record struct {
+	N int
+}
+
+// Size of each test record, e.g. {"N":1}
+const recordSize = headerSize + 7
+
+func consumeAll(t *testing.T, failAt int) ([]int, error) {
+	t.Helper()
+	var got []int
+	_, err := Consume(func(b []byte) error {
+		r := record{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("Could not decode %q: %v", b, err)
+		}
+		if r.N == failAt {
+			return errors.New("db down")
+		}
+		got = append(got, r.N)
+		return nil
+	})
+	return got, err
+}
+
+func appendAll(t *testing.T, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := Append(record{i}); err != nil {
+			t.Fatal("Could not append:", err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func Test_Spool(t *testing.T) {
+	dir := t.TempDir()
+	Close()
+	if err := Append(record{0}); !errors.Is(err, ErrDisabled) {
+		t.Error("Expected ErrDisabled before Init, got", err)
+	}
+	if err := Init(dir, 1024); err != nil {
+		t.Fatal("Could not init spool:", err)
+	}
+	appendAll(t, 1, 5)
+	if n, size := Pending(); n != 5 || size != 5*recordSize {
+		t.Errorf("Expected 5 pending records, got %d (%d bytes)", n, size)
+	}
+	select {
+	case <-Appended():
+	default:
+		t.Error("Expected to be notified of appended records")
+	}
+	if Lag() <= 0 {
+		t.Error("Expected lag with pending records, got", Lag())
+	}
+
+	// Consuming stops at the failure, keeping the rest.
+	got, err := consumeAll(t, 3)
+	if err == nil || len(got) != 2 {
+		t.Errorf("Expected 2 consumed then error, got %v, %v", got, err)
+	}
+	if n, _ := Pending(); n != 3 {
+		t.Errorf("Expected 3 pending records, got %d", n)
+	}
+	// New records are consumed after older ones.
+	appendAll(t, 6, 6)
+	got, err = consumeAll(t, -1)
+	if err != nil || len(got) != 4 || got[0] != 3 || got[3] != 6 {
+		t.Errorf("Expected 3 to 6 consumed, got %v, %v", got, err)
+	}
+	if n, size := Pending(); n != 0 || size != 0 || Lag() != 0 {
+		t.Errorf("Expected empty spool, got %d (%d bytes), lag %s", n, size, Lag())
+	}
+	if Totals().Consumed != 6 {
+		t.Error("Expected 6 consumed in total, got", Totals().Consumed)
+	}
+
+	// Bounded by the size of records not yet consumed.
+	for i := 0; i < 1024/recordSize; i++ {
+		if err := Append(record{0}); err != nil {
+			t.Fatal("Could not append:", err)
+		}
+	}
+	if err := Append(record{0}); !errors.Is(err, ErrFull) || !Full() || Totals().Dropped != 1 {
+		t.Errorf("Expected spool to be full with 1 dropped, got %v, %v, %d", err, Full(), Totals().Dropped)
+	}
+	consumeAll(t, -1)
+	if Full() {
+		t.Error("Expected spool not to be full once consumed")
+	}
+	Close()
+}
+
+func Test_SpoolSegments(t *testing.T) {
+	defer func(b int64) { SegmentBytes = b }(SegmentBytes)
+	SegmentBytes = 3 * recordSize
+	dir := t.TempDir()
+	if err := Init(dir, 1024); err != nil {
+		t.Fatal("Could not init spool:", err)
+	}
+	appendAll(t, 1, 7)
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("Expected 3 segments, got %v", files)
+	}
+
+	// Consumed segments are removed, except the one being appended to.
+	got, err := consumeAll(t, 5)
+	if err == nil || len(got) != 4 {
+		t.Errorf("Expected 4 consumed then error, got %v, %v", got, err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 2 {
+		t.Errorf("Expected 2 segments, got %v", files)
+	}
+	got, err = consumeAll(t, -1)
+	if err != nil || len(got) != 3 || got[0] != 5 {
+		t.Errorf("Expected 5 to 7 consumed, got %v, %v", got, err)
+	}
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected 1 segment, got %v", files)
+	}
+	Close()
+}
+
+func Test_SpoolRecovery(t *testing.T) {
+	defer func(b int64) { SegmentBytes = b }(SegmentBytes)
+	SegmentBytes = 3 * recordSize
+	dir := t.TempDir()
+	if err := Init(dir, 1024); err != nil {
+		t.Fatal("Could not init spool:", err)
+	}
+	appendAll(t, 1, 8)
+	if got, err := consumeAll(t, 3); len(got) != 2 {
+		t.Fatalf("Expected 2 consumed, got %v, %v", got, err)
+	}
+	Close()
+
+	// Corrupt a record in the middle segment, and partially write one to the
+	// last, as if we crashed.
+	files := segmentFiles(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 segments, got %v", files)
+	}
+	f, err := os.OpenFile(files[1], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), 2*recordSize-1)
+	f.Close()
+	f, err = os.OpenFile(files[2], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeRecord(time.Now(), []byte(`{"N":9}`))[:recordSize-2])
+	f.Close()
+
+	// Only records not consumed before the restart are counted: the first
+	// segment's last, the middle segment's before the corrupt record, and the
+	// last segment's complete records.
+	if err := Init(dir, 1024); err != nil {
+		t.Fatal("Could not init spool:", err)
+	}
+	if n, size := Pending(); n != 4 || size != 4*recordSize {
+		t.Errorf("Expected 4 pending records after restart, got %d (%d bytes)", n, size)
+	}
+	appendAll(t, 10, 10)
+	corrupt := Totals().Corrupt
+	got, err := consumeAll(t, -1)
+	if err != nil || len(got) != 5 || got[0] != 3 || got[1] != 4 || got[2] != 7 || got[4] != 10 {
+		t.Errorf("Expected 3, 4, 7, 8, 10 consumed, got %v, %v", got, err)
+	}
+	if Totals().Corrupt != corrupt+1 {
+		t.Errorf("Expected a corrupt segment to be skipped, got %d", Totals().Corrupt-corrupt)
+	}
+	if n, size := Pending(); n != 0 || size != 0 {
+		t.Errorf("Expected empty spool, got %d (%d bytes)", n, size)
+	}
+	Close()
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -23,7 +24,7 @@ var S *tsnet.Server
 var LC *tailscale.LocalClient
 
 // true if we're connected to a tailnet successfully
-var Connected bool
+var Connected atomic.Bool
 
 // current tailnet DNS suffix
 var DNSSuffix string
@@ -60,7 +61,7 @@ func Init(tsname string, dir string, timeout time.Duration) error {
 			stateStr = status.BackendState
 			if stateStr == "Running" {
 				log.Printf("Connected to Tailscale as %s (%s)", status.Self.DNSName, status.Self.TailscaleIPs[0])
-				Connected = true
+				Connected.Store(true)
 				DNSSuffix = status.CurrentTailnet.MagicDNSSuffix
 				break
 			}
@@ -76,15 +77,26 @@ func Init(tsname string, dir string, timeout time.Duration) error {
 	return nil
 }
 
-func Serve(h http.Handler) error {
+// Serves srv on the tailnet until it is shut down, returning
+// http.ErrServerClosed if so.
+func Serve(srv *http.Server) error {
 	ln, err := S.Listen("tcp", ":80")
 	if err != nil {
 		return err
 	}
 
 	log.Print("Ready to serve on Tailscale!")
-	err = http.Serve(ln, h)
-	// Not expecting to return, so mark ourselves as disconnected if/when it does
-	Connected = false
+	err = srv.Serve(ln)
+	// Mark ourselves as disconnected whenever we stop serving
+	Connected.Store(false)
 	return err
 }
+
+// Disconnects from the tailnet.
+func Close() error {
+	if S == nil {
+		return nil
+	}
+	Connected.Store(false)
+	return S.Close()
+}
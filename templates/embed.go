@@ -2,6 +2,7 @@ package templates
 
 import (
 	"embed"
+	htmltemplate "html/template"
 	"text/template"
 )
 
@@ -12,3 +13,9 @@ var files embed.FS
 func Get(name string) (*template.Template, error) {
 	return template.ParseFS(files, name)
 }
+
+// Returns the named embedded template, parsed as an html/template so values
+// are escaped for their context.
+func GetHTML(name string) (*htmltemplate.Template, error) {
+	return htmltemplate.ParseFS(files, name)
+}
@@ -0,0 +1,122 @@
+// Lightweight User-Agent parsing into browser, OS and device class.
+//
+// This only aims to recognise the common browsers well enough for dashboard
+// breakdowns, anything unusual is reported as "Other".
+package useragent
+
+import "strings"
+
+type DeviceClass string
+
+const (
+	DEVICE_DESKTOP DeviceClass = "desktop"
+	DEVICE_MOBILE  DeviceClass = "mobile"
+	DEVICE_TABLET  DeviceClass = "tablet"
+	DEVICE_BOT     DeviceClass = "bot"
+)
+
+const Other = "Other"
+
+type Info struct {
+	Browser        string
+	BrowserVersion string // Major version only
+	OS             string
+	Device         DeviceClass
+}
+
+// Substrings (lowercase) identifying automated clients.
+var botTokens = []string{
+	"bot", "spider", "slurp", "crawl", "headless", "lighthouse",
+	"curl/", "wget/", "python-requests", "python-urllib", "go-http-client",
+	"java/", "okhttp", "httpclient", "facebookexternalhit", "preview",
+}
+
+// Browser tokens, in the order they must be checked as most browsers also
+// claim to be Chrome and/or Safari.
+var browsers = []struct {
+	token string
+	name  string
+}{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"}, // Only when Safari/ is also present, see below.
+}
+
+// OS tokens, in order (Android claims Linux, iOS claims Mac OS X).
+var systems = []struct {
+	token string
+	name  string
+}{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"iPod", "iOS"},
+	{"CrOS", "ChromeOS"},
+	{"Macintosh", "macOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// Parses a raw User-Agent header.
+func Parse(ua string) Info {
+	rv := Info{Browser: Other, OS: Other, Device: DEVICE_DESKTOP}
+	for _, sys := range systems {
+		if strings.Contains(ua, sys.token) {
+			rv.OS = sys.name
+			break
+		}
+	}
+	for _, b := range browsers {
+		i := strings.Index(ua, b.token)
+		if i < 0 || (b.name == "Safari" && !strings.Contains(ua, "Safari/")) {
+			continue
+		}
+		rv.Browser = b.name
+		rv.BrowserVersion = majorVersion(ua[i+len(b.token):])
+		break
+	}
+	rv.Device = deviceClass(ua)
+	return rv
+}
+
+// Returns the leading digits of v.
+func majorVersion(v string) string {
+	end := strings.IndexFunc(v, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if end < 0 {
+		return v
+	}
+	return v[:end]
+}
+
+func deviceClass(ua string) DeviceClass {
+	// Real browsers always send a User-Agent.
+	if strings.TrimSpace(ua) == "" {
+		return DEVICE_BOT
+	}
+	lower := strings.ToLower(ua)
+	for _, token := range botTokens {
+		if strings.Contains(lower, token) {
+			return DEVICE_BOT
+		}
+	}
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"):
+		return DEVICE_TABLET
+	case strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		return DEVICE_TABLET
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPod"):
+		return DEVICE_MOBILE
+	}
+	return DEVICE_DESKTOP
+}
@@ -0,0 +1,36 @@
+package useragent
+
+import "testing"
+
+func Test_Parse(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want Info
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			Info{"Chrome", "120", "Windows", DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			Info{"Edge", "120", "Windows", DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			Info{"Safari", "17", "macOS", DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			Info{"Firefox", "121", "Linux", DEVICE_DESKTOP}},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			Info{"Safari", "17", "iOS", DEVICE_MOBILE}},
+		{"Mozilla/5.0 (iPad; CPU OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/120.0.6099.119 Mobile/15E148 Safari/604.1",
+			Info{"Chrome", "120", "iOS", DEVICE_TABLET}},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			Info{"Chrome", "120", "Android", DEVICE_MOBILE}},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36",
+			Info{"Samsung Internet", "23", "Android", DEVICE_TABLET}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{Other, "", Other, DEVICE_BOT}},
+		{"curl/8.4.0", Info{Other, "", Other, DEVICE_BOT}},
+		{"", Info{Other, "", Other, DEVICE_BOT}},
+	}
+	for i, test := range tests {
+		if got := Parse(test.ua); got != test.want {
+			t.Errorf("Test %d: Parse(%q) = %+v, want %+v", i, test.ua, got, test.want)
+		}
+	}
+}